@@ -0,0 +1,725 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/helpers"
+	internalTypes "wuzapi/internal/types"
+	webhooks "wuzapi/webhook"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+type AdminController struct {
+	*controller.Server
+}
+
+func (s *AdminController) SignRoutes(c alice.Chain) {
+	s.Router.Handle("/admin/users", c.Then(s.ListUsers())).Methods("GET")
+	s.Router.Handle("/admin/users", c.Then(s.CreateUser())).Methods("POST")
+	s.Router.Handle("/admin/users/{id:[0-9]+}", c.Then(s.UpdateUser())).Methods("PUT")
+	s.Router.Handle("/admin/users/{id:[0-9]+}", c.Then(s.DeleteUser())).Methods("DELETE")
+	s.Router.Handle("/admin/users/{id:[0-9]+}/expiration", c.Then(s.SetExpiration())).Methods("POST")
+	s.Router.Handle("/admin/users/{id:[0-9]+}/tokens", c.Then(s.ListTokens())).Methods("GET")
+	s.Router.Handle("/admin/users/{id:[0-9]+}/tokens", c.Then(s.CreateToken())).Methods("POST")
+	s.Router.Handle("/admin/users/{id:[0-9]+}/tokens/{tokenid:[0-9]+}", c.Then(s.DeleteToken())).Methods("DELETE")
+}
+
+type userStruct struct {
+	Id         int
+	Name       string
+	Webhook    string
+	Jid        string
+	Events     string
+	Expiration int64
+	Connected  bool
+	LoggedIn   bool
+}
+
+// Validates a comma separated list of event types, defaults to All
+func parseEvents(events string) (string, error) {
+	var subscribedEvents []string
+	for _, arg := range strings.Split(events, ",") {
+		arg = strings.TrimSpace(arg)
+		if arg == "" {
+			continue
+		}
+		if !helpers.Find(internalTypes.MessageTypes, arg) {
+			return "", fmt.Errorf("Invalid event type: %s", arg)
+		}
+		if !helpers.Find(subscribedEvents, arg) {
+			subscribedEvents = append(subscribedEvents, arg)
+		}
+	}
+	if len(subscribedEvents) < 1 {
+		subscribedEvents = append(subscribedEvents, "All")
+	}
+	return strings.Join(subscribedEvents, ","), nil
+}
+
+// Gets a single user row by id
+func (s *AdminController) getUser(userid int) (*userStruct, error) {
+	u := userStruct{}
+	var expiration sql.NullInt64
+	err := s.Db.QueryRow("SELECT id,name,webhook,jid,events,expiration FROM users WHERE id=? LIMIT 1", userid).Scan(&u.Id, &u.Name, &u.Webhook, &u.Jid, &u.Events, &expiration)
+	if err != nil {
+		return nil, err
+	}
+	u.Expiration = expiration.Int64
+	if client := s.Sessions.Client(u.Id); client != nil {
+		u.Connected = client.IsConnected()
+		u.LoggedIn = client.IsLoggedIn()
+	}
+	return &u, nil
+}
+
+// Lists all users
+func (s *AdminController) ListUsers() http.HandlerFunc {
+
+	type UserCollection struct {
+		Users []userStruct
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		rows, err := s.Db.Query("SELECT id,name,webhook,jid,events,expiration FROM users ORDER BY id")
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list users: %v", err))
+			return
+		}
+		defer rows.Close()
+
+		uc := new(UserCollection)
+		uc.Users = []userStruct{}
+		for rows.Next() {
+			u := userStruct{}
+			var expiration sql.NullInt64
+			err = rows.Scan(&u.Id, &u.Name, &u.Webhook, &u.Jid, &u.Events, &expiration)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list users: %v", err))
+				return
+			}
+			u.Expiration = expiration.Int64
+			if client := s.Sessions.Client(u.Id); client != nil {
+				u.Connected = client.IsConnected()
+				u.LoggedIn = client.IsLoggedIn()
+			}
+			uc.Users = append(uc.Users, u)
+		}
+		err = rows.Err()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list users: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Validates a list of token scopes
+func parseScopes(scopes []string) ([]string, error) {
+	var validScopes []string
+	for _, arg := range scopes {
+		if !helpers.Find(internalTypes.Scopes, arg) {
+			return nil, fmt.Errorf("Invalid scope: %s", arg)
+		}
+		if !helpers.Find(validScopes, arg) {
+			validScopes = append(validScopes, arg)
+		}
+	}
+	if len(validScopes) < 1 {
+		return nil, errors.New("Missing Scopes in Payload")
+	}
+	return validScopes, nil
+}
+
+// Returns the supplied token or generates one, failing if it is too short or already in use
+func (s *AdminController) newToken(token string) (string, int, error) {
+	if token == "" {
+		token, err := helpers.GenerateToken()
+		if err != nil {
+			return "", http.StatusInternalServerError, fmt.Errorf("Could not generate token: %v", err)
+		}
+		return token, http.StatusOK, nil
+	}
+	if len(token) < helpers.MinTokenLength {
+		return "", http.StatusBadRequest, fmt.Errorf("Token must be at least %d characters long", helpers.MinTokenLength)
+	}
+	existing, err := s.FindToken(token)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if existing != nil {
+		return "", http.StatusConflict, errors.New("Token already in use")
+	}
+	return token, http.StatusOK, nil
+}
+
+// Creates a user, generating a token if none is supplied
+func (s *AdminController) CreateUser() http.HandlerFunc {
+
+	type createUserStruct struct {
+		Name       string
+		Token      string
+		Scopes     []string
+		Webhook    string
+		Events     string
+		Expiration int64
+	}
+
+	type createdUserStruct struct {
+		userStruct
+		Token  string
+		Scopes []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		decoder := json.NewDecoder(r.Body)
+		var t createUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+
+		events, err := parseEvents(t.Events)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if webhooks.IsBroker(t.Webhook) {
+			s.Respond(w, r, http.StatusBadRequest, webhooks.ErrBrokerWebhook)
+			return
+		}
+
+		scopes := []string{internalTypes.ScopeAll}
+		if len(t.Scopes) > 0 {
+			scopes, err = parseScopes(t.Scopes)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+
+		token, status, err := s.newToken(t.Token)
+		if err != nil {
+			s.Respond(w, r, status, err)
+			return
+		}
+
+		// The user and its token are created together so no user is left without a token
+		tx, err := s.Db.Begin()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create user: %v", err))
+			return
+		}
+		defer tx.Rollback()
+
+		res, err := tx.Exec("INSERT INTO users (name,token,webhook,events,expiration) VALUES (?,'',?,?,?)", t.Name, t.Webhook, events, t.Expiration)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create user: %v", err))
+			return
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create user: %v", err))
+			return
+		}
+
+		_, err = s.Server.CreateTokenTx(tx, int(id), "default", token, scopes)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create token: %v", err))
+			return
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create user: %v", err))
+			return
+		}
+
+		u, err := s.getUser(int(id))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		log.Info().Int64("userid", id).Str("name", t.Name).Msg("User created")
+		responseJson, err := json.Marshal(createdUserStruct{userStruct: *u, Token: token, Scopes: scopes})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
+		}
+		return
+	}
+}
+
+// Updates name, webhook, events or expiration for a user
+func (s *AdminController) UpdateUser() http.HandlerFunc {
+
+	type updateUserStruct struct {
+		Name       *string
+		Webhook    *string
+		Events     *string
+		Expiration *int64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		u, err := s.getUser(userid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t updateUserStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Name != nil {
+			if *t.Name == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Name cannot be empty"))
+				return
+			}
+			u.Name = *t.Name
+		}
+		if t.Webhook != nil {
+			if webhooks.IsBroker(*t.Webhook) {
+				s.Respond(w, r, http.StatusBadRequest, webhooks.ErrBrokerWebhook)
+				return
+			}
+			u.Webhook = *t.Webhook
+		}
+		if t.Events != nil {
+			u.Events, err = parseEvents(*t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if t.Expiration != nil {
+			u.Expiration = *t.Expiration
+		}
+
+		_, err = s.Db.Exec("UPDATE users SET name=?,webhook=?,events=?,expiration=? WHERE id=?", u.Name, u.Webhook, u.Events, u.Expiration, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not update user: %v", err))
+			return
+		}
+
+		// Keep cached user information and the running session in sync
+		myuserinfo, found := s.UserInfoCache.Get(strconv.Itoa(userid))
+		if found {
+			v := helpers.UpdateUserInfo(myuserinfo, "Webhook", u.Webhook)
+			v = helpers.UpdateUserInfo(v, "Events", u.Events)
+			v = helpers.UpdateUserInfo(v, "Expiration", strconv.FormatInt(u.Expiration, 10))
+			s.UserInfoCache.Set(strconv.Itoa(userid), v, cache.NoExpiration)
+		}
+		if sess, ok := s.Sessions.Get(userid); ok {
+			sess.SetSubscriptions(strings.Split(u.Events, ","))
+		}
+		// An expiration in the past disconnects the user right away
+		if helpers.IsExpired(strconv.FormatInt(u.Expiration, 10)) {
+			s.Sessions.Kill(userid)
+		}
+
+		log.Info().Int("userid", userid).Msg("User updated")
+		responseJson, err := json.Marshal(u)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Extends, sets or revokes the expiration of a user token
+func (s *AdminController) SetExpiration() http.HandlerFunc {
+
+	type expirationStruct struct {
+		Expiration int64
+		Extend     int64
+		Revoke     bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		u, err := s.getUser(userid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t expirationStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Revoke {
+			u.Expiration = 0
+		} else if t.Extend > 0 {
+			// Extends from current expiration, or from now if already expired
+			base := u.Expiration
+			if base < time.Now().Unix() {
+				base = time.Now().Unix()
+			}
+			u.Expiration = base + t.Extend
+		} else if t.Expiration > 0 {
+			u.Expiration = t.Expiration
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Expiration, Extend or Revoke in Payload"))
+			return
+		}
+
+		_, err = s.Db.Exec("UPDATE users SET expiration=? WHERE id=?", u.Expiration, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not update expiration: %v", err))
+			return
+		}
+
+		myuserinfo, found := s.UserInfoCache.Get(strconv.Itoa(userid))
+		if found {
+			v := helpers.UpdateUserInfo(myuserinfo, "Expiration", strconv.FormatInt(u.Expiration, 10))
+			s.UserInfoCache.Set(strconv.Itoa(userid), v, cache.NoExpiration)
+		}
+		// An expiration in the past disconnects the user right away
+		if helpers.IsExpired(strconv.FormatInt(u.Expiration, 10)) {
+			s.Sessions.Kill(userid)
+		}
+
+		log.Info().Int("userid", userid).Int64("expiration", u.Expiration).Msg("User expiration updated")
+		responseJson, err := json.Marshal(u)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Deletes a user, logging out and removing its whatsapp device
+func (s *AdminController) DeleteUser() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		u, err := s.getUser(userid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		// Rows are deleted in one transaction before touching the session, so a failure
+		// leaves the user as it was
+		tx, err := s.Db.Begin()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete user: %v", err))
+			return
+		}
+		defer tx.Rollback()
+
+		tables := []struct {
+			name string
+			what string
+		}{
+			{"tokens", "user tokens"},
+			{"message_receipts", "user messages"},
+			{"messages", "user messages"},
+			{"polls", "user polls"},
+			{"group_snapshots", "user group snapshots"},
+			{"webhook_queue", "user webhooks"},
+			{"webhook_dead_letters", "user webhooks"},
+			{"webhooks", "user webhooks"},
+			{"webhook_secrets", "user webhooks"},
+			{"send_consumers", "user consumer"},
+			{"send_queue", "user send queue"},
+			{"send_limits", "user send queue"},
+			{"scheduled_messages", "user scheduled messages"},
+			{"bulk_recipients", "user bulk jobs"},
+			{"bulk_jobs", "user bulk jobs"},
+			{"idempotency_keys", "user idempotency keys"},
+		}
+		for _, table := range tables {
+			_, err = tx.Exec("DELETE FROM "+table.name+" WHERE user_id=?", userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete %s: %v", table.what, err))
+				return
+			}
+		}
+		_, err = tx.Exec("DELETE FROM users WHERE id=?", userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete user: %v", err))
+			return
+		}
+		err = tx.Commit()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete user: %v", err))
+			return
+		}
+
+		client := s.Sessions.Client(userid)
+		if client != nil {
+			if client.IsLoggedIn() {
+				err = client.Logout()
+				if err != nil {
+					log.Warn().Err(err).Int("userid", userid).Msg("Could not perform logout")
+				}
+			}
+			s.Sessions.Kill(userid)
+			if client.Store.ID != nil {
+				err = client.Store.Delete()
+				if err != nil {
+					log.Warn().Err(err).Int("userid", userid).Msg("Could not delete device store")
+				}
+			}
+		} else if u.Jid != "" {
+			jid, ok := helpers.ParseJID(u.Jid)
+			if ok {
+				device, err := s.Container.GetDevice(jid)
+				if err != nil {
+					log.Warn().Err(err).Int("userid", userid).Msg("Could not get device store")
+				} else if device != nil {
+					err = device.Delete()
+					if err != nil {
+						log.Warn().Err(err).Int("userid", userid).Msg("Could not delete device store")
+					}
+				}
+			}
+		}
+		s.Sessions.Forget(userid)
+		s.Stream.Forget(userid)
+		s.Consumers.Stop(userid)
+		s.UserInfoCache.Delete(strconv.Itoa(userid))
+		s.ForgetTokens(userid, 0)
+
+		log.Info().Int("userid", userid).Msg("User deleted")
+		response := map[string]interface{}{"Details": "User deleted", "Id": userid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Lists the named tokens of a user
+func (s *AdminController) ListTokens() http.HandlerFunc {
+
+	type TokenCollection struct {
+		Tokens []controller.Token
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		_, err := s.getUser(userid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		rows, err := s.Db.Query("SELECT id,user_id,name,scopes,created FROM tokens WHERE user_id=? ORDER BY id", userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list tokens: %v", err))
+			return
+		}
+		defer rows.Close()
+
+		tc := new(TokenCollection)
+		tc.Tokens = []controller.Token{}
+		for rows.Next() {
+			t := controller.Token{}
+			scopes := ""
+			err = rows.Scan(&t.Id, &t.UserId, &t.Name, &scopes, &t.Created)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list tokens: %v", err))
+				return
+			}
+			t.Scopes = strings.Split(scopes, ",")
+			tc.Tokens = append(tc.Tokens, t)
+		}
+		err = rows.Err()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list tokens: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(tc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Creates a named token with scopes for a user, the token is only shown once
+func (s *AdminController) CreateToken() http.HandlerFunc {
+
+	type createTokenStruct struct {
+		Name   string
+		Token  string
+		Scopes []string
+	}
+
+	type createdTokenStruct struct {
+		Id      int
+		UserId  int
+		Name    string
+		Scopes  []string
+		Created int64
+		Token   string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+		_, err := s.getUser(userid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get user: %v", err))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t createTokenStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+
+		scopes, err := parseScopes(t.Scopes)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var count int
+		err = s.Db.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id=? AND name=?", userid, t.Name).Scan(&count)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if count > 0 {
+			s.Respond(w, r, http.StatusConflict, errors.New("Token name already in use"))
+			return
+		}
+
+		token, status, err := s.newToken(t.Token)
+		if err != nil {
+			s.Respond(w, r, status, err)
+			return
+		}
+
+		id, err := s.Server.CreateToken(userid, t.Name, token, scopes)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create token: %v", err))
+			return
+		}
+
+		log.Info().Int("userid", userid).Str("name", t.Name).Strs("scopes", scopes).Msg("Token created")
+		created := createdTokenStruct{Id: int(id), UserId: userid, Name: t.Name, Scopes: scopes, Created: time.Now().Unix(), Token: token}
+		responseJson, err := json.Marshal(created)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
+		}
+		return
+	}
+}
+
+// Deletes a named token of a user
+func (s *AdminController) DeleteToken() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		userid, _ := strconv.Atoi(mux.Vars(r)["id"])
+		tokenid, _ := strconv.Atoi(mux.Vars(r)["tokenid"])
+
+		res, err := s.Db.Exec("DELETE FROM tokens WHERE id=? AND user_id=?", tokenid, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete token: %v", err))
+			return
+		}
+		affected, _ := res.RowsAffected()
+		if affected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Token not found"))
+			return
+		}
+		s.ForgetTokens(userid, tokenid)
+
+		log.Info().Int("userid", userid).Int("tokenid", tokenid).Msg("Token deleted")
+		response := map[string]interface{}{"Details": "Token deleted", "Id": tokenid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
@@ -0,0 +1,207 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"wuzapi/internal/controller"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+)
+
+type AdminWebhookController struct {
+	*controller.Server
+}
+
+func (s *AdminWebhookController) SignRoutes(c alice.Chain) {
+	s.Router.Handle("/admin/webhooks/deadletters", c.Then(s.ListDeadLetters())).Methods("GET")
+	s.Router.Handle("/admin/webhooks/deadletters/replay", c.Then(s.ReplayDeadLetters())).Methods("POST")
+	s.Router.Handle("/admin/webhooks/deadletters/{id:[0-9]+}", c.Then(s.GetDeadLetter())).Methods("GET")
+	s.Router.Handle("/admin/webhooks/deadletters/{id:[0-9]+}", c.Then(s.DeleteDeadLetter())).Methods("DELETE")
+	s.Router.Handle("/admin/webhooks/deadletters/{id:[0-9]+}/replay", c.Then(s.ReplayDeadLetter())).Methods("POST")
+}
+
+// Lists webhook deliveries that ran out of attempts, newest first
+func (s *AdminWebhookController) ListDeadLetters() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query()
+		userid := 0
+		before := int64(0)
+		limit := 50
+		var err error
+
+		if query.Get("user") != "" {
+			userid, err = strconv.Atoi(query.Get("user"))
+			if err != nil || userid < 1 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user"))
+				return
+			}
+		}
+		if query.Get("cursor") != "" {
+			before, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+			if err != nil || before < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid cursor"))
+				return
+			}
+		}
+		if query.Get("limit") != "" {
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Limit must be between 1 and 500"))
+				return
+			}
+		}
+
+		list, err := s.Outbox.DeadLetters(userid, before, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list dead letters: %v", err))
+			return
+		}
+
+		nextCursor := int64(0)
+		if len(list) == limit {
+			nextCursor = list[len(list)-1].Id
+		}
+
+		response := map[string]interface{}{"DeadLetters": list, "NextCursor": nextCursor}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets a single dead lettered delivery with its payload and last error
+func (s *AdminWebhookController) GetDeadLetter() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		d, err := s.Outbox.DeadLetter(id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get dead letter: %v", err))
+			return
+		}
+		if d == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Dead letter not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(d)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Queues a dead lettered delivery again with its attempts reset
+func (s *AdminWebhookController) ReplayDeadLetter() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		replayed, err := s.Outbox.Replay(id, 0)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not replay dead letter: %v", err))
+			return
+		}
+		if replayed == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Dead letter not found"))
+			return
+		}
+
+		log.Info().Int64("id", id).Msg("Dead letter replayed")
+		response := map[string]interface{}{"Details": "Replayed", "Replayed": replayed}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Queues again every dead lettered delivery, or only those of a user
+func (s *AdminWebhookController) ReplayDeadLetters() http.HandlerFunc {
+
+	type replayStruct struct {
+		UserId int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		var t replayStruct
+		if r.ContentLength != 0 {
+			decoder := json.NewDecoder(r.Body)
+			err := decoder.Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+				return
+			}
+		}
+		if t.UserId < 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid UserId"))
+			return
+		}
+
+		replayed, err := s.Outbox.Replay(0, t.UserId)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not replay dead letters: %v", err))
+			return
+		}
+
+		log.Info().Int("userid", t.UserId).Int64("replayed", replayed).Msg("Dead letters replayed")
+		response := map[string]interface{}{"Details": "Replayed", "Replayed": replayed}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Discards a dead lettered delivery
+func (s *AdminWebhookController) DeleteDeadLetter() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		deleted, err := s.Outbox.DeleteDeadLetter(id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete dead letter: %v", err))
+			return
+		}
+		if !deleted {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Dead letter not found"))
+			return
+		}
+
+		log.Info().Int64("id", id).Msg("Dead letter deleted")
+		response := map[string]interface{}{"Details": "Dead letter deleted", "Id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
@@ -0,0 +1,476 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"wuzapi/internal/bulk"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/helpers"
+	"wuzapi/internal/sendqueue"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Recipients a bulk send can have at most
+const maxBulkRecipients = 10000
+
+type ChatBulkController struct {
+	*controller.Server
+}
+
+func (s *ChatBulkController) SignRoutes(c alice.Chain) {
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/chat/send/bulk", send.Then(s.Idempotent(s.SendBulk()))).Methods("POST")
+	s.Router.Handle("/chat/bulk", read.Then(s.ListJobs())).Methods("GET")
+	s.Router.Handle("/chat/bulk/{id:[0-9]+}", read.Then(s.GetJob())).Methods("GET")
+	s.Router.Handle("/chat/bulk/{id:[0-9]+}/report", read.Then(s.GetReport())).Methods("GET")
+	s.Router.Handle("/chat/bulk/{id:[0-9]+}", send.Then(s.CancelJob())).Methods("DELETE")
+}
+
+// Sends a message to many recipients through the send queue. The Body is a template
+// filled with the Variables of every recipient, and the caption when media is sent.
+func (s *ChatBulkController) SendBulk() http.HandlerFunc {
+
+	type recipientStruct struct {
+		Phone     string
+		Variables map[string]string
+	}
+
+	type bulkStruct struct {
+		Name            string
+		Body            string
+		Image           string
+		Video           string
+		Document        string
+		Audio           string
+		FileName        string
+		CheckOnWhatsapp bool
+		Recipients      []recipientStruct
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t bulkStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Recipients) == 0 || len(t.Recipients) > maxBulkRecipients {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Recipients must have between 1 and %d entries", maxBulkRecipients))
+			return
+		}
+
+		msgType := "text"
+		media := ""
+		for name, data := range map[string]string{"image": t.Image, "video": t.Video, "document": t.Document, "audio": t.Audio} {
+			if data == "" {
+				continue
+			}
+			if media != "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Only one of Image, Video, Document or Audio can be set"))
+				return
+			}
+			msgType = name
+			media = data
+		}
+		if msgType == "text" && t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+		if msgType == "document" && t.FileName == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
+			return
+		}
+
+		body, err := template.New("body").Option("missingkey=error").Parse(t.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Invalid Body template: %v", err))
+			return
+		}
+
+		// Recipients that can not be sent to are kept in the report with the reason
+		recipients := make([]bulk.Recipient, len(t.Recipients))
+		texts := make([]string, len(t.Recipients))
+		phones := []string{}
+		for i, rc := range t.Recipients {
+			recipients[i] = bulk.Recipient{Phone: rc.Phone, Variables: rc.Variables, Status: sendqueue.StatusPending}
+			jid, ok := helpers.ParseJID(rc.Phone)
+			if !ok {
+				recipients[i].Status = bulk.StatusInvalid
+				recipients[i].Error = "Could not parse Phone"
+				continue
+			}
+			recipients[i].Jid = jid.String()
+
+			variables := map[string]string{"Phone": jid.User}
+			for name, value := range rc.Variables {
+				variables[name] = value
+			}
+			var text bytes.Buffer
+			err = body.Execute(&text, variables)
+			if err != nil {
+				recipients[i].Status = bulk.StatusInvalid
+				recipients[i].Error = err.Error()
+				continue
+			}
+			texts[i] = text.String()
+			phones = append(phones, "+"+jid.User)
+		}
+
+		if t.CheckOnWhatsapp && len(phones) > 0 {
+			found := make(map[string]string)
+			for start := 0; start < len(phones); start += 100 {
+				end := start + 100
+				if end > len(phones) {
+					end = len(phones)
+				}
+				resp, err := client.IsOnWhatsApp(phones[start:end])
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Failed to check if users are on WhatsApp: %v", err))
+					return
+				}
+				for _, item := range resp {
+					if item.IsIn {
+						found[strings.TrimPrefix(item.Query, "+")] = item.JID.String()
+					}
+				}
+			}
+			for i := range recipients {
+				if recipients[i].Status != sendqueue.StatusPending {
+					continue
+				}
+				jid, ok := helpers.ParseJID(recipients[i].Jid)
+				if ok && found[jid.User] != "" {
+					recipients[i].Jid = found[jid.User]
+				} else {
+					recipients[i].Status = bulk.StatusNotOnWhatsapp
+					recipients[i].Error = "Not on Whatsapp"
+				}
+			}
+		}
+
+		// Media is uploaded once and shared by every message
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+		if media != "" {
+			dataURL, err := dataurl.DecodeString(media)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			}
+			filedata = dataURL.Data
+			mediaTypes := map[string]whatsmeow.MediaType{"image": whatsmeow.MediaImage, "video": whatsmeow.MediaVideo, "document": whatsmeow.MediaDocument, "audio": whatsmeow.MediaAudio}
+			uploaded, err = client.Upload(context.Background(), filedata, mediaTypes[msgType])
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Failed to upload file: %v", err))
+				return
+			}
+		}
+
+		for i := range recipients {
+			if recipients[i].Status == sendqueue.StatusPending {
+				recipients[i].MessageId = whatsmeow.GenerateMessageID()
+			}
+		}
+		job := bulk.Job{UserId: userid, Name: t.Name, Type: msgType}
+		ids, err := bulk.Create(s.Db, &job, recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create bulk job: %v", err))
+			return
+		}
+
+		for i, rc := range recipients {
+			if rc.Status != sendqueue.StatusPending {
+				continue
+			}
+			jid, _ := helpers.ParseJID(rc.Jid)
+			msg := bulkMessage(msgType, texts[i], t.FileName, uploaded, filedata)
+			queueId, err := s.SendQueue.Enqueue(userid, jid, rc.MessageId, msgType, msg)
+			err = bulk.SetQueued(s.Db, ids[i], queueId, err)
+			if err != nil {
+				log.Error().Err(err).Str("userid", txtid).Int64("job", job.Id).Msg("Could not update bulk recipient")
+			}
+		}
+
+		created, err := bulk.Get(s.Db, userid, job.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get bulk job: %v", err))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("job", job.Id).Int("recipients", job.Total).Int("queued", created.Counts[sendqueue.StatusPending]).Msg("Bulk send queued")
+		responseJson, err := json.Marshal(created)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
+		}
+		return
+	}
+}
+
+// Builds the message of one recipient of a bulk send
+func bulkMessage(msgType string, text string, fileName string, uploaded whatsmeow.UploadResponse, filedata []byte) *waProto.Message {
+	switch msgType {
+	case "image":
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:       proto.String(text),
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+		}}
+	case "video":
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:       proto.String(text),
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+		}}
+	case "document":
+		return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			Caption:       proto.String(text),
+			Url:           proto.String(uploaded.URL),
+			FileName:      proto.String(fileName),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+		}}
+	case "audio":
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Url:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String("audio/ogg; codecs=opus"),
+			FileEncSha256: uploaded.FileEncSHA256,
+			FileSha256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			Ptt:           proto.Bool(true),
+		}}
+	}
+	return &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(text)}}
+}
+
+// Lists bulk jobs with their progress, newest first
+func (s *ChatBulkController) ListJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		query := r.URL.Query()
+		cursor := int64(0)
+		if query.Get("cursor") != "" {
+			var err error
+			cursor, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+			if err != nil || cursor < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid cursor"))
+				return
+			}
+		}
+
+		limit := 50
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Limit must be between 1 and 500"))
+				return
+			}
+		}
+
+		list, err := bulk.List(s.Db, userid, cursor, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list bulk jobs: %v", err))
+			return
+		}
+
+		// A full page might have more jobs after it
+		nextCursor := int64(0)
+		if len(list) == limit {
+			nextCursor = list[len(list)-1].Id
+		}
+
+		response := map[string]interface{}{"Jobs": list, "NextCursor": nextCursor}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets a bulk job with its progress
+func (s *ChatBulkController) GetJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		job, err := bulk.Get(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get bulk job: %v", err))
+			return
+		}
+		if job == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Bulk job not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(job)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets the result of every recipient of a bulk job, as JSON or as CSV with format=csv
+func (s *ChatBulkController) GetReport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Format must be json or csv"))
+			return
+		}
+
+		job, err := bulk.Get(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get bulk job: %v", err))
+			return
+		}
+		if job == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Bulk job not found"))
+			return
+		}
+		recipients, err := bulk.Recipients(s.Db, job.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get bulk recipients: %v", err))
+			return
+		}
+
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"bulk-%d.csv\"", job.Id))
+			out := csv.NewWriter(w)
+			out.Write([]string{"phone", "jid", "status", "message_id", "queue_id", "error", "sent"})
+			for _, rc := range recipients {
+				sent := ""
+				if rc.Sent > 0 {
+					sent = time.Unix(rc.Sent, 0).UTC().Format(time.RFC3339)
+				}
+				out.Write([]string{rc.Phone, rc.Jid, rc.Status, rc.MessageId, strconv.FormatInt(rc.QueueId, 10), rc.Error, sent})
+			}
+			out.Flush()
+			return
+		}
+
+		response := map[string]interface{}{"Job": job, "Recipients": recipients}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Cancels the messages of a bulk job not sent yet
+func (s *ChatBulkController) CancelJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		job, err := bulk.Get(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get bulk job: %v", err))
+			return
+		}
+		if job == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Bulk job not found"))
+			return
+		}
+		if job.Status != bulk.StatusRunning {
+			s.Respond(w, r, http.StatusConflict, errors.New("Bulk job is already "+job.Status))
+			return
+		}
+
+		queueIds, err := bulk.Cancel(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel bulk job: %v", err))
+			return
+		}
+		cancelled := int64(0)
+		for _, queueId := range queueIds {
+			n, err := s.SendQueue.Cancel(userid, queueId)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel bulk job: %v", err))
+				return
+			}
+			cancelled += n
+		}
+
+		log.Info().Str("userid", txtid).Int64("job", id).Int64("count", cancelled).Msg("Bulk job cancelled")
+		response := map[string]interface{}{"Details": "Cancelled", "Count": cancelled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
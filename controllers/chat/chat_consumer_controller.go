@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/outbound"
+	internalTypes "wuzapi/internal/types"
+	"wuzapi/webhook"
+
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+)
+
+type ChatConsumerController struct {
+	*controller.Server
+}
+
+func (s *ChatConsumerController) SignRoutes(c alice.Chain) {
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+
+	s.Router.Handle("/chat/consumer", send.Then(s.GetConsumer())).Methods("GET")
+	s.Router.Handle("/chat/consumer", send.Then(s.SetConsumer())).Methods("POST")
+	s.Router.Handle("/chat/consumer", send.Then(s.DeleteConsumer())).Methods("DELETE")
+}
+
+// Gets the broker queue messages to send are consumed from
+func (s *ChatConsumerController) GetConsumer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		cfg, err := outbound.GetConfig(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get consumer: %v", err))
+			return
+		}
+		if cfg == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No consumer set"))
+			return
+		}
+
+		response := map[string]interface{}{"Consumer": cfg, "Running": s.Consumers.Running(userid)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sets the broker queue messages to send are consumed from, restarting the consumer if the session is up
+func (s *ChatConsumerController) SetConsumer() http.HandlerFunc {
+
+	type consumerStruct struct {
+		Url           string
+		Subject       string
+		ResultSubject *string
+		Enabled       *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t consumerStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		u, err := url.Parse(t.Url)
+		if err != nil || !webhook.IsBroker(t.Url) || u.Host == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Url must be a valid nats, amqp or redis URL"))
+			return
+		}
+		if strings.TrimSpace(t.Subject) == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Subject in Payload"))
+			return
+		}
+
+		cfg := outbound.Config{UserId: userid, Url: t.Url, Subject: t.Subject, ResultSubject: outbound.DefaultResultSubject, Enabled: true}
+		if t.ResultSubject != nil {
+			cfg.ResultSubject = *t.ResultSubject
+		}
+		if t.Enabled != nil {
+			cfg.Enabled = *t.Enabled
+		}
+		err = outbound.SaveConfig(s.Db, &cfg)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set consumer: %v", err))
+			return
+		}
+
+		if sess, running := s.Sessions.Get(userid); running {
+			s.StartConsumer(sess.Context(), userid)
+		} else {
+			s.Consumers.Stop(userid)
+		}
+
+		log.Info().Str("userid", txtid).Str("subject", cfg.Subject).Msg("Send consumer set")
+		response := map[string]interface{}{"Consumer": cfg, "Running": s.Consumers.Running(userid)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Stops consuming messages to send from a broker and removes its configuration
+func (s *ChatConsumerController) DeleteConsumer() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		s.Consumers.Stop(userid)
+		found, err := outbound.DeleteConfig(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete consumer: %v", err))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No consumer set"))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Msg("Send consumer deleted")
+		response := map[string]interface{}{"Details": "Consumer deleted"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"time"
 	"wuzapi/internal/controller"
 	"wuzapi/internal/helpers"
+	"wuzapi/internal/messages"
+	"wuzapi/internal/sendqueue"
 	internalTypes "wuzapi/internal/types"
 
 	"github.com/justinas/alice"
@@ -28,13 +30,126 @@ type ChatController struct {
 }
 
 func (s *ChatController) SignRoutes(c alice.Chain) {
-	s.Router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
-	s.Router.Handle("/chat/presence", c.Then(s.ChatPresence())).Methods("POST")
-	s.Router.Handle("/chat/markread", c.Then(s.MarkRead())).Methods("POST")
-	s.Router.Handle("/chat/downloadimage", c.Then(s.DownloadImage())).Methods("POST")
-	s.Router.Handle("/chat/downloadvideo", c.Then(s.DownloadVideo())).Methods("POST")
-	s.Router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
-	s.Router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/chat/react", send.Then(s.React())).Methods("POST")
+	s.Router.Handle("/chat/revoke", send.Then(s.Revoke())).Methods("POST")
+	s.Router.Handle("/chat/edit", send.Then(s.Edit())).Methods("POST")
+	s.Router.Handle("/chat/presence", send.Then(s.ChatPresence())).Methods("POST")
+	s.Router.Handle("/chat/markread", send.Then(s.MarkRead())).Methods("POST")
+	s.Router.Handle("/chat/downloadimage", read.Then(s.DownloadImage())).Methods("POST")
+	s.Router.Handle("/chat/downloadvideo", read.Then(s.DownloadVideo())).Methods("POST")
+	s.Router.Handle("/chat/downloadaudio", read.Then(s.DownloadAudio())).Methods("POST")
+	s.Router.Handle("/chat/downloaddocument", read.Then(s.DownloadDocument())).Methods("POST")
+	s.Router.Handle("/chat/messages", read.Then(s.ListMessages())).Methods("GET")
+	s.Router.Handle("/chat/status", read.Then(s.MessageStatus())).Methods("GET")
+}
+
+// Gets the delivery status of a message, with per participant detail for groups
+func (s *ChatController) MessageStatus() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing id"))
+			return
+		}
+
+		m, receipts, err := messages.Get(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get message status: %v", err))
+			return
+		}
+		if m == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+			return
+		}
+
+		response := map[string]interface{}{"Id": m.MessageId, "Chat": m.ChatJid, "Direction": m.Direction, "Status": m.Status, "Timestamp": m.Timestamp, "Receipts": receipts}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Lists stored messages, newest first, filtered by chat, direction and time range
+func (s *ChatController) ListMessages() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		query := r.URL.Query()
+		filter := messages.Filter{UserId: userid, Limit: 50}
+
+		if chat := query.Get("chat"); chat != "" {
+			jid, ok := helpers.ParseJID(chat)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
+				return
+			}
+			filter.ChatJid = jid.String()
+		}
+
+		filter.Direction = query.Get("direction")
+		if filter.Direction != "" && filter.Direction != messages.DirectionIn && filter.Direction != messages.DirectionOut {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Direction must be in or out"))
+			return
+		}
+
+		numbers := map[string]*int64{"since": &filter.Since, "until": &filter.Until, "cursor": &filter.Before}
+		for name, target := range numbers {
+			if query.Get(name) == "" {
+				continue
+			}
+			value, err := strconv.ParseInt(query.Get(name), 10, 64)
+			if err != nil || value < 0 {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Invalid %s", name))
+				return
+			}
+			*target = value
+		}
+
+		if query.Get("limit") != "" {
+			limit, err := strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Limit must be between 1 and 500"))
+				return
+			}
+			filter.Limit = limit
+		}
+
+		list, err := messages.List(s.Db, filter)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list messages: %v", err))
+			return
+		}
+
+		// A full page might have more messages after it
+		nextCursor := int64(0)
+		if len(list) == filter.Limit {
+			nextCursor = list[len(list)-1].Id
+		}
+
+		response := map[string]interface{}{"Messages": list, "NextCursor": nextCursor}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
 }
 
 // Sets Chat Presence (typing/paused/recording audio)
@@ -51,7 +166,8 @@ func (s *ChatController) ChatPresence() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -80,7 +196,7 @@ func (s *ChatController) ChatPresence() http.HandlerFunc {
 			return
 		}
 
-		err = s.ClientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		err = client.SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
 			return
@@ -118,7 +234,8 @@ func (s *ChatController) DownloadImage() http.HandlerFunc {
 		mimetype := ""
 		var imgdata []byte
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -155,7 +272,7 @@ func (s *ChatController) DownloadImage() http.HandlerFunc {
 		img := msg.GetImageMessage()
 
 		if img != nil {
-			imgdata, err = s.ClientPointer[userid].Download(img)
+			imgdata, err = client.Download(img)
 			if err != nil {
 				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
 				msg := fmt.Sprintf("Failed to download image %v", err)
@@ -198,7 +315,8 @@ func (s *ChatController) DownloadDocument() http.HandlerFunc {
 		mimetype := ""
 		var docdata []byte
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -235,7 +353,7 @@ func (s *ChatController) DownloadDocument() http.HandlerFunc {
 		doc := msg.GetDocumentMessage()
 
 		if doc != nil {
-			docdata, err = s.ClientPointer[userid].Download(doc)
+			docdata, err = client.Download(doc)
 			if err != nil {
 				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
 				msg := fmt.Sprintf("Failed to download document %v", err)
@@ -278,7 +396,8 @@ func (s *ChatController) DownloadVideo() http.HandlerFunc {
 		mimetype := ""
 		var docdata []byte
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -315,7 +434,7 @@ func (s *ChatController) DownloadVideo() http.HandlerFunc {
 		doc := msg.GetVideoMessage()
 
 		if doc != nil {
-			docdata, err = s.ClientPointer[userid].Download(doc)
+			docdata, err = client.Download(doc)
 			if err != nil {
 				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
 				msg := fmt.Sprintf("Failed to download video %v", err)
@@ -358,7 +477,8 @@ func (s *ChatController) DownloadAudio() http.HandlerFunc {
 		mimetype := ""
 		var docdata []byte
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -395,7 +515,7 @@ func (s *ChatController) DownloadAudio() http.HandlerFunc {
 		doc := msg.GetAudioMessage()
 
 		if doc != nil {
-			docdata, err = s.ClientPointer[userid].Download(doc)
+			docdata, err = client.Download(doc)
 			if err != nil {
 				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
 				msg := fmt.Sprintf("Failed to download audio %v", err)
@@ -431,7 +551,8 @@ func (s *ChatController) React() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -494,13 +615,14 @@ func (s *ChatController) React() http.HandlerFunc {
 			},
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
+		resp, err = client.SendMessage(context.Background(), recipient, msg)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		s.StoreSentMessage(userid, client, recipient, resp, msg)
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -513,6 +635,236 @@ func (s *ChatController) React() http.HandlerFunc {
 	}
 }
 
+// Revokes a message for everyone. Group admins can also revoke messages of others by
+// setting Sender, which defaults to the sender of the stored message. Messages still
+// waiting in the send queue are cancelled instead.
+func (s *ChatController) Revoke() http.HandlerFunc {
+
+	type revokeStruct struct {
+		Phone  string
+		Id     string
+		Sender string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t revokeStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		}
+
+		chat, ok := helpers.ParseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		queued, err := s.SendQueue.FindMessage(userid, t.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not check send queue: %v", err))
+			return
+		}
+		if queued != nil && queued.Status == sendqueue.StatusPending {
+			cancelled, err := s.SendQueue.Cancel(userid, queued.Id)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel queued message: %v", err))
+				return
+			}
+			if cancelled > 0 {
+				log.Info().Str("userid", txtid).Int64("queueid", queued.Id).Str("id", t.Id).Msg("Queued message cancelled")
+				response := map[string]interface{}{"Details": "Cancelled", "QueueId": queued.Id, "Id": t.Id}
+				responseJson, err := json.Marshal(response)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, err)
+				} else {
+					s.Respond(w, r, http.StatusOK, string(responseJson))
+				}
+				return
+			}
+		}
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		sender := types.EmptyJID
+		if t.Sender != "" {
+			sender, ok = helpers.ParseJID(t.Sender)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Sender"))
+				return
+			}
+		} else {
+			stored, _, err := messages.GetInChat(s.Db, userid, chat.String(), t.Id)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get message: %v", err))
+				return
+			}
+			if stored == nil {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+				return
+			}
+			if stored.Direction == messages.DirectionIn {
+				// Messages stored before senders were kept without device can still carry one
+				sender, _ = types.ParseJID(stored.SenderJid)
+				sender = sender.ToNonAD()
+			}
+		}
+		if !sender.IsEmpty() && chat.Server != types.GroupServer && client.Store.ID != nil && sender.User != client.Store.ID.User {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Messages of others can only be revoked in groups"))
+			return
+		}
+
+		resp, err := client.SendMessage(context.Background(), chat, client.BuildRevoke(chat, sender, t.Id))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Error revoking message: %v", err))
+			return
+		}
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message revoked")
+		err = messages.SetRevoked(s.Db, userid, chat.String(), t.Id, resp.Timestamp.Unix())
+		if err != nil {
+			log.Error().Err(err).Str("id", t.Id).Msg("Could not store message revoke")
+		}
+		response := map[string]interface{}{"Details": "Revoked", "Timestamp": resp.Timestamp, "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Replaces the text of a message we sent, or the caption of an image, video or document.
+// Whatsapp only accepts edits within 20 minutes of sending.
+func (s *ChatController) Edit() http.HandlerFunc {
+
+	type editStruct struct {
+		Phone string
+		Id    string
+		Body  string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t editStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		chat, ok := helpers.ParseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		// The stored message tells whether it is ours, still editable and what to replace
+		stored, _, err := messages.GetInChat(s.Db, userid, chat.String(), t.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get message: %v", err))
+			return
+		}
+		if stored == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+			return
+		}
+		if stored.Direction != messages.DirectionOut {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Only messages we sent can be edited"))
+			return
+		}
+		if stored.Revoked > 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Message was revoked"))
+			return
+		}
+		if time.Since(time.Unix(stored.Timestamp, 0)) > whatsmeow.EditWindow {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Messages can only be edited within 20 minutes of sending"))
+			return
+		}
+
+		var content *waProto.Message
+		switch stored.Type {
+		case "text":
+			content = &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(t.Body)}}
+		case "image":
+			content = &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: proto.String(t.Body)}}
+		case "video":
+			content = &waProto.Message{VideoMessage: &waProto.VideoMessage{Caption: proto.String(t.Body)}}
+		case "document":
+			content = &waProto.Message{DocumentMessage: &waProto.DocumentMessage{Caption: proto.String(t.Body)}}
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Only text messages and captions can be edited"))
+			return
+		}
+
+		resp, err := client.SendMessage(context.Background(), chat, client.BuildEdit(chat, t.Id, content))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Error editing message: %v", err))
+			return
+		}
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message edited")
+		err = messages.SetEdited(s.Db, userid, chat.String(), t.Id, t.Body, resp.Timestamp.Unix())
+		if err != nil {
+			log.Error().Err(err).Str("id", t.Id).Msg("Could not store message edit")
+		}
+		response := map[string]interface{}{"Details": "Edited", "Timestamp": resp.Timestamp, "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
 // Mark messages as read
 func (s *ChatController) MarkRead() http.HandlerFunc {
 
@@ -527,7 +879,8 @@ func (s *ChatController) MarkRead() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -550,7 +903,7 @@ func (s *ChatController) MarkRead() http.HandlerFunc {
 			return
 		}
 
-		err = s.ClientPointer[userid].MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
+		err = client.MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure marking messages as read"))
 			return
@@ -25,16 +25,28 @@ type ChatMessageController struct {
 }
 
 func (s *ChatMessageController) SignRoutes(c alice.Chain) {
-	s.Router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
-	s.Router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
-	s.Router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
-	s.Router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
-	s.Router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
-	s.Router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
-	s.Router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
-	s.Router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
-	s.Router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
-	s.Router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+
+	handlers := map[string]http.HandlerFunc{
+		"text":     s.SendMessage(),
+		"image":    s.SendImage(),
+		"audio":    s.SendAudio(),
+		"document": s.SendDocument(),
+		"video":    s.SendVideo(),
+		"sticker":  s.SendSticker(),
+		"location": s.SendLocation(),
+		"contact":  s.SendContact(),
+		"buttons":  s.SendButtons(),
+		"list":     s.SendList(),
+		"poll":     s.SendPoll(),
+	}
+	for name, handler := range handlers {
+		// Payloads with SendAt or Cron are scheduled instead of sent
+		handler = s.Schedulable(name, handler)
+		s.Router.Handle("/chat/send/"+name, send.Then(s.Idempotent(handler))).Methods("POST")
+		// Messages consumed from brokers go through the same handlers
+		s.SendHandlers[name] = handler
+	}
 }
 
 // Sends a regular text message
@@ -42,7 +54,6 @@ func (s *ChatMessageController) SendMessage() http.HandlerFunc {
 
 	type textStruct struct {
 		message.Message
-		Phone       string
 		Body        string
 		Id          string
 		ContextInfo waProto.ContextInfo
@@ -53,13 +64,13 @@ func (s *ChatMessageController) SendMessage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t textStruct
@@ -108,22 +119,7 @@ func (s *ChatMessageController) SendMessage() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Error sending message: %v", err))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "text", msg)
 	}
 }
 
@@ -132,7 +128,6 @@ func (s *ChatMessageController) SendImage() http.HandlerFunc {
 
 	type imageStruct struct {
 		message.Message
-		Phone       string
 		Image       string
 		Caption     string
 		Id          string
@@ -144,9 +139,9 @@ func (s *ChatMessageController) SendImage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -192,7 +187,7 @@ func (s *ChatMessageController) SendImage() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = s.ClientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaImage)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -222,21 +217,7 @@ func (s *ChatMessageController) SendImage() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "image", msg)
 	}
 }
 
@@ -245,7 +226,6 @@ func (s *ChatMessageController) SendSticker() http.HandlerFunc {
 
 	type stickerStruct struct {
 		message.Message
-		Phone        string
 		Sticker      string
 		Id           string
 		PngThumbnail []byte
@@ -257,9 +237,9 @@ func (s *ChatMessageController) SendSticker() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -305,7 +285,7 @@ func (s *ChatMessageController) SendSticker() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = s.ClientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaImage)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -335,21 +315,7 @@ func (s *ChatMessageController) SendSticker() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "sticker", msg)
 	}
 }
 
@@ -358,7 +324,6 @@ func (s *ChatMessageController) SendVideo() http.HandlerFunc {
 
 	type imageStruct struct {
 		message.Message
-		Phone         string
 		Video         string
 		Caption       string
 		Id            string
@@ -371,9 +336,9 @@ func (s *ChatMessageController) SendVideo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -419,7 +384,7 @@ func (s *ChatMessageController) SendVideo() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = s.ClientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaVideo)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -450,21 +415,7 @@ func (s *ChatMessageController) SendVideo() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "video", msg)
 	}
 }
 
@@ -473,7 +424,6 @@ func (s *ChatMessageController) SendContact() http.HandlerFunc {
 
 	type contactStruct struct {
 		message.Message
-		Phone       string
 		Id          string
 		Name        string
 		Vcard       string
@@ -485,13 +435,13 @@ func (s *ChatMessageController) SendContact() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t contactStruct
@@ -539,21 +489,7 @@ func (s *ChatMessageController) SendContact() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "contact", msg)
 	}
 }
 
@@ -562,7 +498,6 @@ func (s *ChatMessageController) SendLocation() http.HandlerFunc {
 
 	type locationStruct struct {
 		message.Message
-		Phone       string
 		Id          string
 		Name        string
 		Latitude    float64
@@ -575,13 +510,13 @@ func (s *ChatMessageController) SendLocation() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t locationStruct
@@ -630,21 +565,7 @@ func (s *ChatMessageController) SendLocation() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "location", msg)
 	}
 }
 
@@ -668,13 +589,13 @@ func (s *ChatMessageController) SendButtons() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t textStruct
@@ -732,25 +653,13 @@ func (s *ChatMessageController) SendButtons() http.HandlerFunc {
 			Buttons:     buttons,
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+		msg := &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
 			Message: &waProto.Message{
 				ButtonsMessage: msg2,
 			},
-		}})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+		}}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "buttons", msg)
 	}
 }
 
@@ -784,13 +693,13 @@ func (s *ChatMessageController) SendList() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
 			return
 		}
 
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
 		var t listStruct
@@ -872,26 +781,14 @@ func (s *ChatMessageController) SendList() http.HandlerFunc {
 			FooterText:  proto.String(t.FooterText),
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{
+		msg := &waProto.Message{
 			ViewOnceMessage: &waProto.FutureProofMessage{
 				Message: &waProto.Message{
 					ListMessage: msg1,
 				},
-			}})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+			}}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "list", msg)
 	}
 }
 
@@ -900,7 +797,6 @@ func (s *ChatMessageController) SendDocument() http.HandlerFunc {
 
 	type documentStruct struct {
 		message.Message
-		Phone       string
 		Document    string
 		FileName    string
 		Id          string
@@ -912,9 +808,9 @@ func (s *ChatMessageController) SendDocument() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -965,7 +861,7 @@ func (s *ChatMessageController) SendDocument() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = s.ClientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaDocument)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -995,21 +891,7 @@ func (s *ChatMessageController) SendDocument() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-		return
+		s.QueueMessage(w, r, userid, recipient, msgid, "document", msg)
 	}
 }
 
@@ -1018,7 +900,6 @@ func (s *ChatMessageController) SendAudio() http.HandlerFunc {
 
 	type audioStruct struct {
 		message.Message
-		Phone       string
 		Audio       string
 		Caption     string
 		Id          string
@@ -1030,9 +911,9 @@ func (s *ChatMessageController) SendAudio() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -1078,7 +959,7 @@ func (s *ChatMessageController) SendAudio() http.HandlerFunc {
 				return
 			} else {
 				filedata = dataURL.Data
-				uploaded, err = s.ClientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaAudio)
 				if err != nil {
 					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
 					return
@@ -1112,20 +993,95 @@ func (s *ChatMessageController) SendAudio() http.HandlerFunc {
 			}
 		}
 
-		resp, err = s.ClientPointer[userid].SendMessage(context.Background(), recipient, msg)
+		s.QueueMessage(w, r, userid, recipient, msgid, "audio", msg)
+	}
+}
+
+// Sends a poll. Votes come back as PollVote events naming the selected options.
+func (s *ChatMessageController) SendPoll() http.HandlerFunc {
+
+	type pollStruct struct {
+		message.Message
+		Id      string
+		Name    string
+		Options []string
+		// How many options a voter can select, 0 for any number
+		SelectableCount int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+
+		decoder := json.NewDecoder(r.Body)
+		var t pollStruct
+		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+		if len(t.Options) < 2 || len(t.Options) > 12 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Options must have between 2 and 12 items"))
+			return
+		}
+		// Votes only carry hashes of the option names, so they have to be unique
+		seen := map[string]bool{}
+		for _, option := range t.Options {
+			if option == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Options can not be empty"))
+				return
+			}
+			if seen[option] {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Options must be unique"))
+				return
+			}
+			seen[option] = true
+		}
+		if t.SelectableCount < 0 || t.SelectableCount > len(t.Options) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("SelectableCount must be between 0 and the number of Options"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		recipient, err := t.ValidateMessageFields()
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
 		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			msgid = t.Id
+		}
+
+		msg := client.BuildPollCreation(t.Name, t.Options, t.SelectableCount)
+
+		if t.ContextInfo.StanzaId != nil {
+			msg.PollCreationMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
 		}
-		return
+
+		s.QueueMessage(w, r, userid, recipient, msgid, "poll", msg)
 	}
 }
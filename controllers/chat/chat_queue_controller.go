@@ -0,0 +1,287 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/helpers"
+	"wuzapi/internal/sendqueue"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+)
+
+type ChatQueueController struct {
+	*controller.Server
+}
+
+func (s *ChatQueueController) SignRoutes(c alice.Chain) {
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/chat/queue", read.Then(s.ListQueue())).Methods("GET")
+	s.Router.Handle("/chat/queue", send.Then(s.CancelQueue())).Methods("DELETE")
+	s.Router.Handle("/chat/queue/limits", read.Then(s.GetLimits())).Methods("GET")
+	s.Router.Handle("/chat/queue/limits", send.Then(s.SetLimits())).Methods("POST")
+	s.Router.Handle("/chat/queue/{id:[0-9]+}", read.Then(s.GetQueued())).Methods("GET")
+	s.Router.Handle("/chat/queue/{id:[0-9]+}", send.Then(s.CancelQueued())).Methods("DELETE")
+}
+
+// Lists queued messages, newest first, pending and failed ones unless a status is given
+func (s *ChatQueueController) ListQueue() http.HandlerFunc {
+
+	statuses := []string{sendqueue.StatusPending, sendqueue.StatusSending, sendqueue.StatusSent, sendqueue.StatusFailed, sendqueue.StatusCancelled}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		query := r.URL.Query()
+		filter := []string{sendqueue.StatusPending, sendqueue.StatusSending, sendqueue.StatusFailed}
+		if query.Get("status") != "" {
+			filter = strings.Split(query.Get("status"), ",")
+			for _, status := range filter {
+				if !helpers.Find(statuses, status) {
+					s.Respond(w, r, http.StatusBadRequest, errors.New("Status must be one of "+strings.Join(statuses, ", ")))
+					return
+				}
+			}
+		}
+
+		cursor := int64(0)
+		if query.Get("cursor") != "" {
+			var err error
+			cursor, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+			if err != nil || cursor < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid cursor"))
+				return
+			}
+		}
+
+		limit := 50
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Limit must be between 1 and 500"))
+				return
+			}
+		}
+
+		list, err := s.SendQueue.List(userid, filter, cursor, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list queue: %v", err))
+			return
+		}
+		counts, err := s.SendQueue.Counts(userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list queue: %v", err))
+			return
+		}
+		sentToday, err := s.SendQueue.SentToday(userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list queue: %v", err))
+			return
+		}
+
+		// A full page might have more items after it
+		nextCursor := int64(0)
+		if len(list) == limit {
+			nextCursor = list[len(list)-1].Id
+		}
+
+		response := map[string]interface{}{"Items": list, "Counts": counts, "SentToday": sentToday, "NextCursor": nextCursor}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets a queued message
+func (s *ChatQueueController) GetQueued() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		item, err := s.SendQueue.Get(userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get queued message: %v", err))
+			return
+		}
+		if item == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Queued message not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(item)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Cancels a pending message, or dismisses a failed one
+func (s *ChatQueueController) CancelQueued() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		cancelled, err := s.SendQueue.Cancel(userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel queued message: %v", err))
+			return
+		}
+		if cancelled == 0 {
+			item, err := s.SendQueue.Get(userid, id)
+			if err == nil && item != nil {
+				s.Respond(w, r, http.StatusConflict, errors.New("Message is already "+item.Status))
+			} else {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Queued message not found"))
+			}
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("queueid", id).Msg("Queued message cancelled")
+		response := map[string]interface{}{"Details": "Cancelled", "QueueId": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Cancels every pending message
+func (s *ChatQueueController) CancelQueue() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		cancelled, err := s.SendQueue.Cancel(userid, 0)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel queue: %v", err))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("count", cancelled).Msg("Send queue cancelled")
+		response := map[string]interface{}{"Details": "Cancelled", "Count": cancelled}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets the pacing limits of the send queue
+func (s *ChatQueueController) GetLimits() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		limits, err := sendqueue.GetLimits(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get limits: %v", err))
+			return
+		}
+
+		responseJson, err := json.Marshal(limits)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sets the pacing limits of the send queue, fields left out keep their value
+func (s *ChatQueueController) SetLimits() http.HandlerFunc {
+
+	type limitsStruct struct {
+		PerMinute         *int
+		JitterMin         *int
+		JitterMax         *int
+		RecipientInterval *int
+		DailyCap          *int
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t limitsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		limits, err := sendqueue.GetLimits(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get limits: %v", err))
+			return
+		}
+		fields := map[string]*int{"PerMinute": t.PerMinute, "JitterMin": t.JitterMin, "JitterMax": t.JitterMax, "RecipientInterval": t.RecipientInterval, "DailyCap": t.DailyCap}
+		targets := map[string]*int{"PerMinute": &limits.PerMinute, "JitterMin": &limits.JitterMin, "JitterMax": &limits.JitterMax, "RecipientInterval": &limits.RecipientInterval, "DailyCap": &limits.DailyCap}
+		for name, value := range fields {
+			if value == nil {
+				continue
+			}
+			if *value < 0 {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("%s can not be negative", name))
+				return
+			}
+			*targets[name] = *value
+		}
+		if limits.PerMinute > 600 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("PerMinute can not be over 600"))
+			return
+		}
+		if limits.JitterMax < limits.JitterMin {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("JitterMax can not be lower than JitterMin"))
+			return
+		}
+
+		err = sendqueue.SaveLimits(s.Db, limits)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set limits: %v", err))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int("per_minute", limits.PerMinute).Int("daily_cap", limits.DailyCap).Msg("Send limits set")
+		responseJson, err := json.Marshal(limits)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
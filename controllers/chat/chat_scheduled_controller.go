@@ -0,0 +1,156 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/helpers"
+	"wuzapi/internal/scheduler"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+)
+
+type ChatScheduledController struct {
+	*controller.Server
+}
+
+func (s *ChatScheduledController) SignRoutes(c alice.Chain) {
+	send := c.Append(s.RequireScope(internalTypes.ScopeSend))
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/chat/scheduled", read.Then(s.ListScheduled())).Methods("GET")
+	s.Router.Handle("/chat/scheduled/{id:[0-9]+}", read.Then(s.GetScheduled())).Methods("GET")
+	s.Router.Handle("/chat/scheduled/{id:[0-9]+}", send.Then(s.CancelScheduled())).Methods("DELETE")
+}
+
+// Lists scheduled messages, newest first, the ones still to send unless a status is given
+func (s *ChatScheduledController) ListScheduled() http.HandlerFunc {
+
+	statuses := []string{scheduler.StatusScheduled, scheduler.StatusDone, scheduler.StatusFailed, scheduler.StatusCancelled}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		query := r.URL.Query()
+		status := scheduler.StatusScheduled
+		if query.Has("status") {
+			status = query.Get("status")
+			if status != "" && !helpers.Find(statuses, status) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Status must be scheduled, done, failed or cancelled"))
+				return
+			}
+		}
+
+		cursor := int64(0)
+		if query.Get("cursor") != "" {
+			var err error
+			cursor, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+			if err != nil || cursor < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid cursor"))
+				return
+			}
+		}
+
+		limit := 50
+		if query.Get("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 1 || limit > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Limit must be between 1 and 500"))
+				return
+			}
+		}
+
+		list, err := s.Scheduler.List(userid, status, cursor, limit)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list scheduled messages: %v", err))
+			return
+		}
+
+		// A full page might have more messages after it
+		nextCursor := int64(0)
+		if len(list) == limit {
+			nextCursor = list[len(list)-1].Id
+		}
+
+		response := map[string]interface{}{"Scheduled": list, "NextCursor": nextCursor}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets a scheduled message
+func (s *ChatScheduledController) GetScheduled() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		m, err := s.Scheduler.Get(userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get scheduled message: %v", err))
+			return
+		}
+		if m == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Scheduled message not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(m)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Cancels a scheduled message, recurring ones are not sent again
+func (s *ChatScheduledController) CancelScheduled() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		cancelled, err := s.Scheduler.Cancel(userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not cancel scheduled message: %v", err))
+			return
+		}
+		if !cancelled {
+			m, err := s.Scheduler.Get(userid, id)
+			if err == nil && m != nil {
+				s.Respond(w, r, http.StatusConflict, errors.New("Scheduled message is already "+m.Status))
+			} else {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Scheduled message not found"))
+			}
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("scheduleid", id).Msg("Scheduled message cancelled")
+		response := map[string]interface{}{"Details": "Cancelled", "ScheduleId": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
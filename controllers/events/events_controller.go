@@ -0,0 +1,204 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wuzapi/internal/controller"
+	"wuzapi/internal/helpers"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/gorilla/websocket"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/log"
+)
+
+const heartbeatInterval = 25 * time.Second
+
+type EventsController struct {
+	*controller.Server
+}
+
+func (s *EventsController) SignRoutes(c alice.Chain) {
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/events/ws", read.Then(s.WebSocket())).Methods("GET")
+	s.Router.Handle("/events/sse", read.Then(s.ServerSentEvents())).Methods("GET")
+}
+
+// Clients authenticate with their token, not cookies, so any origin may connect
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Reads the event types and the id to resume after from the request
+func streamParams(r *http.Request) ([]string, uint64, error) {
+	query := r.URL.Query()
+
+	types := []string{}
+	if query.Get("types") != "" {
+		for _, t := range strings.Split(query.Get("types"), ",") {
+			t = strings.TrimSpace(t)
+			if !helpers.Find(internalTypes.MessageTypes, t) {
+				return nil, 0, fmt.Errorf("Invalid event type: %s", t)
+			}
+			types = append(types, t)
+		}
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if query.Get("last_event_id") != "" {
+		lastId = query.Get("last_event_id")
+	}
+	after := uint64(0)
+	if lastId != "" {
+		var err error
+		after, err = strconv.ParseUint(lastId, 10, 64)
+		if err != nil {
+			return nil, 0, errors.New("Invalid last event id")
+		}
+	}
+	return types, after, nil
+}
+
+// Notice sent before resuming when some events after the last id were lost
+func gapNotice(after uint64) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"type": "Gap", "lastEventId": after})
+	return data
+}
+
+// Streams events over a WebSocket, one JSON envelope per text message
+func (s *EventsController) WebSocket() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		types, after, err := streamParams(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader already answered the request
+			log.Warn().Err(err).Str("userid", txtid).Msg("Could not upgrade event stream to WebSocket")
+			return
+		}
+		defer conn.Close()
+
+		sub, backlog, gap := s.Stream.Subscribe(userid, types, after)
+		defer s.Stream.Unsubscribe(sub)
+		log.Info().Str("userid", txtid).Msg("WebSocket event stream opened")
+
+		// Incoming messages are ignored, reading is needed to notice the client going away
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		send := func(data []byte) bool {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			return conn.WriteMessage(websocket.TextMessage, data) == nil
+		}
+
+		if gap && !send(gapNotice(after)) {
+			return
+		}
+		for _, evt := range backlog {
+			if !send(evt.Data) {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-closed:
+				log.Info().Str("userid", txtid).Msg("WebSocket event stream closed")
+				return
+			case evt, ok := <-sub.C:
+				if !ok {
+					log.Warn().Str("userid", txtid).Msg("WebSocket event stream too slow, closing")
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(time.Second))
+					return
+				}
+				if !send(evt.Data) {
+					return
+				}
+			case now := <-heartbeat.C:
+				data, _ := json.Marshal(map[string]interface{}{"type": "Heartbeat", "timestamp": now.Unix()})
+				if !send(data) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Streams events as Server-Sent Events, resuming from the Last-Event-ID header
+func (s *EventsController) ServerSentEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		types, after, err := streamParams(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Streaming not supported"))
+			return
+		}
+
+		sub, backlog, gap := s.Stream.Subscribe(userid, types, after)
+		defer s.Stream.Unsubscribe(sub)
+		log.Info().Str("userid", txtid).Msg("SSE event stream opened")
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if gap {
+			fmt.Fprintf(w, "data: %s\n\n", gapNotice(after))
+		}
+		for _, evt := range backlog {
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", evt.Id, evt.Data)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Info().Str("userid", txtid).Msg("SSE event stream closed")
+				return
+			case evt, ok := <-sub.C:
+				if !ok {
+					log.Warn().Str("userid", txtid).Msg("SSE event stream too slow, closing")
+					return
+				}
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", evt.Id, evt.Data)
+			case now := <-heartbeat.C:
+				fmt.Fprintf(w, ": heartbeat %d\n\n", now.Unix())
+			}
+			flusher.Flush()
+		}
+	}
+}
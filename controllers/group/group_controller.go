@@ -6,13 +6,17 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 	"wuzapi/internal/controller"
+	"wuzapi/internal/groups"
 	"wuzapi/internal/helpers"
 	internalTypes "wuzapi/internal/types"
 
 	"github.com/justinas/alice"
 	"github.com/rs/zerolog/log"
 	"github.com/vincent-petithory/dataurl"
+	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/types"
 )
 
@@ -21,11 +25,28 @@ type GroupController struct {
 }
 
 func (s *GroupController) SignRoutes(c alice.Chain) {
-	s.Router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
-	s.Router.Handle("/group/info", c.Then(s.GetGroupInfo())).Methods("GET")
-	s.Router.Handle("/group/invitelink", c.Then(s.GetGroupInviteLink())).Methods("GET")
-	s.Router.Handle("/group/photo", c.Then(s.SetGroupPhoto())).Methods("POST")
-	s.Router.Handle("/group/name", c.Then(s.SetGroupName())).Methods("POST")
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+	groupAdmin := c.Append(s.RequireScope(internalTypes.ScopeGroupAdmin))
+
+	s.Router.Handle("/group/list", read.Then(s.ListGroups())).Methods("GET")
+	s.Router.Handle("/group/info", read.Then(s.GetGroupInfo())).Methods("GET")
+	s.Router.Handle("/group/invitelink", read.Then(s.GetGroupInviteLink())).Methods("GET")
+	s.Router.Handle("/group/invitelink/reset", groupAdmin.Then(s.ResetGroupInviteLink())).Methods("POST")
+	s.Router.Handle("/group/inviteinfo", read.Then(s.GetGroupInviteInfo())).Methods("GET")
+	s.Router.Handle("/group/join", groupAdmin.Then(s.JoinGroup())).Methods("POST")
+	s.Router.Handle("/group/photo", groupAdmin.Then(s.SetGroupPhoto())).Methods("POST")
+	s.Router.Handle("/group/photo/remove", groupAdmin.Then(s.RemoveGroupPhoto())).Methods("POST")
+	s.Router.Handle("/group/name", groupAdmin.Then(s.SetGroupName())).Methods("POST")
+	s.Router.Handle("/group/topic", groupAdmin.Then(s.SetGroupTopic())).Methods("POST")
+	s.Router.Handle("/group/announce", groupAdmin.Then(s.SetGroupAnnounce())).Methods("POST")
+	s.Router.Handle("/group/locked", groupAdmin.Then(s.SetGroupLocked())).Methods("POST")
+	s.Router.Handle("/group/ephemeral", groupAdmin.Then(s.SetDisappearingTimer())).Methods("POST")
+	s.Router.Handle("/group/create", groupAdmin.Then(s.CreateGroup())).Methods("POST")
+	s.Router.Handle("/group/participants", groupAdmin.Then(s.UpdateGroupParticipants())).Methods("POST")
+	s.Router.Handle("/group/leave", groupAdmin.Then(s.LeaveGroup())).Methods("POST")
+	s.Router.Handle("/group/requests", read.Then(s.GetGroupJoinRequests())).Methods("GET")
+	s.Router.Handle("/group/requests", groupAdmin.Then(s.UpdateGroupJoinRequests())).Methods("POST")
+	s.Router.Handle("/group/approval", groupAdmin.Then(s.SetGroupJoinApproval())).Methods("POST")
 }
 
 // List groups
@@ -40,17 +61,18 @@ func (s *GroupController) ListGroups() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		resp, err := s.ClientPointer[userid].GetJoinedGroups()
+		resp, err := client.GetJoinedGroups()
 
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get group list: %v", err)
 			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
 			return
 		}
 
@@ -82,7 +104,8 @@ func (s *GroupController) GetGroupInfo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -101,12 +124,12 @@ func (s *GroupController) GetGroupInfo() http.HandlerFunc {
 			return
 		}
 
-		resp, err := s.ClientPointer[userid].GetGroupInfo(group)
+		resp, err := client.GetGroupInfo(group)
 
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get group info: %v", err)
 			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
 			return
 		}
 
@@ -135,7 +158,8 @@ func (s *GroupController) GetGroupInviteLink() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -154,12 +178,12 @@ func (s *GroupController) GetGroupInviteLink() http.HandlerFunc {
 			return
 		}
 
-		resp, err := s.ClientPointer[userid].GetGroupInviteLink(group, t.Reset)
+		resp, err := client.GetGroupInviteLink(group, t.Reset)
 
 		if err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
 			msg := fmt.Sprintf("Failed to get group invite link: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
 			return
 		}
 
@@ -176,6 +200,217 @@ func (s *GroupController) GetGroupInviteLink() http.HandlerFunc {
 	}
 }
 
+// Reset group invite link, the current link stops working
+func (s *GroupController) ResetGroupInviteLink() http.HandlerFunc {
+
+	type resetGroupInviteLinkStruct struct {
+		GroupJID string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t resetGroupInviteLinkStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		resp, err := client.GetGroupInviteLink(group, true)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to reset group invite link")
+			msg := fmt.Sprintf("Failed to reset group invite link: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group invite link reset successfully", "InviteLink": resp}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// An invite link or code, or the fields of a received GroupInviteMessage
+type groupInvite struct {
+	Code string
+	// Set for invite messages only, with the sender of the message as Inviter
+	GroupJID   string
+	Inviter    string
+	Expiration int64
+}
+
+// Gets the code of an invite link, links can also come without scheme
+func inviteCode(link string) string {
+	link = strings.TrimSpace(link)
+	if i := strings.LastIndex(link, "/"); i >= 0 {
+		link = link[i+1:]
+	}
+	return strings.SplitN(link, "?", 2)[0]
+}
+
+// Validates an invite, returns empty jids for invite links
+func (t *groupInvite) parse() (types.JID, types.JID, string, error) {
+	if t.Code == "" {
+		return types.EmptyJID, types.EmptyJID, "", errors.New("Missing Code in Payload")
+	}
+	if t.GroupJID == "" {
+		return types.EmptyJID, types.EmptyJID, inviteCode(t.Code), nil
+	}
+	group, ok := helpers.ParseJID(t.GroupJID)
+	if !ok {
+		return types.EmptyJID, types.EmptyJID, "", errors.New("Could not parse Group JID")
+	}
+	inviter, ok := helpers.ParseJID(t.Inviter)
+	if !ok {
+		return types.EmptyJID, types.EmptyJID, "", errors.New("Could not parse Inviter")
+	}
+	return group, inviter, t.Code, nil
+}
+
+// Status for a failed invite, revoked and invalid links are the caller's problem
+func inviteStatus(err error) int {
+	switch {
+	case errors.Is(err, whatsmeow.ErrInviteLinkRevoked):
+		return http.StatusGone
+	case errors.Is(err, whatsmeow.ErrInviteLinkInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// Get group info from an invite link or message without joining
+func (s *GroupController) GetGroupInviteInfo() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t groupInvite
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, inviter, code, err := t.parse()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		var resp *types.GroupInfo
+		if group.IsEmpty() {
+			resp, err = client.GetGroupInfoFromLink(code)
+		} else {
+			resp, err = client.GetGroupInfoFromInvite(group, inviter, code, t.Expiration)
+		}
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite info")
+			msg := fmt.Sprintf("Failed to get group invite info: %v", err)
+			s.Respond(w, r, inviteStatus(err), errors.New(msg))
+			return
+		}
+
+		responseJson, err := json.Marshal(resp)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Join group with an invite link, or by accepting an invite message
+func (s *GroupController) JoinGroup() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t groupInvite
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, inviter, code, err := t.parse()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if group.IsEmpty() {
+			group, err = client.JoinGroupWithLink(code)
+		} else {
+			err = client.JoinGroupWithInvite(group, inviter, code, t.Expiration)
+		}
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to join group")
+			msg := fmt.Sprintf("Failed to join group: %v", err)
+			s.Respond(w, r, inviteStatus(err), errors.New(msg))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Str("group", group.String()).Msg("Joined group")
+		response := map[string]interface{}{"Details": "Joined group successfully", "GroupJID": group.String()}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
 // Set group photo
 func (s *GroupController) SetGroupPhoto() http.HandlerFunc {
 
@@ -189,7 +424,8 @@ func (s *GroupController) SetGroupPhoto() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -228,12 +464,12 @@ func (s *GroupController) SetGroupPhoto() http.HandlerFunc {
 			return
 		}
 
-		picture_id, err := s.ClientPointer[userid].SetGroupPhoto(group, filedata)
+		picture_id, err := client.SetGroupPhoto(group, filedata)
 
 		if err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
 			msg := fmt.Sprintf("Failed to set group photo: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
 			return
 		}
 
@@ -250,12 +486,11 @@ func (s *GroupController) SetGroupPhoto() http.HandlerFunc {
 	}
 }
 
-// Set group name
-func (s *GroupController) SetGroupName() http.HandlerFunc {
+// Remove group photo
+func (s *GroupController) RemoveGroupPhoto() http.HandlerFunc {
 
-	type setGroupNameStruct struct {
+	type removeGroupPhotoStruct struct {
 		GroupJID string
-		Name     string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -263,13 +498,14 @@ func (s *GroupController) SetGroupName() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t setGroupNameStruct
+		var t removeGroupPhotoStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -282,21 +518,745 @@ func (s *GroupController) SetGroupName() http.HandlerFunc {
 			return
 		}
 
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+		_, err = client.SetGroupPhoto(group, nil)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to remove group photo")
+			msg := fmt.Sprintf("Failed to remove group photo: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
 			return
 		}
 
-		err = s.ClientPointer[userid].SetGroupName(group, t.Name)
+		response := map[string]interface{}{"Details": "Group Photo removed successfully"}
+		responseJson, err := json.Marshal(response)
 
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
-			msg := fmt.Sprintf("Failed to set group name: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set group topic, the description shown in the group info. An empty Topic removes it.
+func (s *GroupController) SetGroupTopic() http.HandlerFunc {
+
+	type setGroupTopicStruct struct {
+		GroupJID string
+		Topic    *string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group Name set successfully"}
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupTopicStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Topic == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Topic in Payload"))
+			return
+		}
+
+		err = client.SetGroupTopic(group, "", "", *t.Topic)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group topic")
+			msg := fmt.Sprintf("Failed to set group topic: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Topic set successfully"}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set group announce mode, where only admins can send messages
+func (s *GroupController) SetGroupAnnounce() http.HandlerFunc {
+
+	type setGroupAnnounceStruct struct {
+		GroupJID string
+		Announce *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupAnnounceStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Announce == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Announce in Payload"))
+			return
+		}
+
+		err = client.SetGroupAnnounce(group, *t.Announce)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group announce mode")
+			msg := fmt.Sprintf("Failed to set group announce mode: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Announce mode set successfully", "Announce": *t.Announce}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set group locked mode, where only admins can edit the group info
+func (s *GroupController) SetGroupLocked() http.HandlerFunc {
+
+	type setGroupLockedStruct struct {
+		GroupJID string
+		Locked   *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupLockedStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Locked == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Locked in Payload"))
+			return
+		}
+
+		err = client.SetGroupLocked(group, *t.Locked)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group locked mode")
+			msg := fmt.Sprintf("Failed to set group locked mode: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Locked mode set successfully", "Locked": *t.Locked}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set the disappearing messages timer of a group: 24h, 7d, 90d or off
+func (s *GroupController) SetDisappearingTimer() http.HandlerFunc {
+
+	type setDisappearingTimerStruct struct {
+		GroupJID string
+		Duration string
+	}
+
+	durations := map[string]time.Duration{
+		"24h": whatsmeow.DisappearingTimer24Hours,
+		"7d":  whatsmeow.DisappearingTimer7Days,
+		"90d": whatsmeow.DisappearingTimer90Days,
+		"off": whatsmeow.DisappearingTimerOff,
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t setDisappearingTimerStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		duration, ok := durations[t.Duration]
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Duration must be 24h, 7d, 90d or off"))
+			return
+		}
+
+		err = client.SetDisappearingTimer(group, duration)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set disappearing timer")
+			msg := fmt.Sprintf("Failed to set disappearing timer: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Disappearing timer set successfully", "Duration": t.Duration}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set group name
+func (s *GroupController) SetGroupName() http.HandlerFunc {
+
+	type setGroupNameStruct struct {
+		GroupJID string
+		Name     string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupNameStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+
+		err = client.SetGroupName(group, t.Name)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
+			msg := fmt.Sprintf("Failed to set group name: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Name set successfully"}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Parses participant phone numbers or jids, returns the first one that can not be parsed
+func parseParticipants(participants []string) ([]types.JID, string) {
+	jids := []types.JID{}
+	for _, participant := range participants {
+		jid, ok := helpers.ParseJID(participant)
+		if !ok {
+			return nil, participant
+		}
+		jids = append(jids, jid)
+	}
+	return jids, ""
+}
+
+// Create group, the result of adding each participant is in Participants
+func (s *GroupController) CreateGroup() http.HandlerFunc {
+
+	type createGroupStruct struct {
+		Name         string
+		Participants []string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t createGroupStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+
+		if len([]rune(t.Name)) > 25 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Name can not be longer than 25 characters"))
+			return
+		}
+
+		participants, invalid := parseParticipants(t.Participants)
+		if invalid != "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Participant "+invalid))
+			return
+		}
+
+		group, err := client.CreateGroup(whatsmeow.ReqCreateGroup{Name: t.Name, Participants: participants})
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to create group")
+			msg := fmt.Sprintf("Failed to create group: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Str("group", group.JID.String()).Msg("Group created")
+		response := map[string]interface{}{"Details": "Group created successfully", "GroupJID": group.JID.String(), "Group": group, "Participants": groups.FromParticipants(group.Participants)}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Add, remove, promote or demote group participants, with the result for each of them
+func (s *GroupController) UpdateGroupParticipants() http.HandlerFunc {
+
+	type updateParticipantsStruct struct {
+		GroupJID     string
+		Action       string
+		Participants []string
+	}
+
+	actions := []string{string(whatsmeow.ParticipantChangeAdd), string(whatsmeow.ParticipantChangeRemove), string(whatsmeow.ParticipantChangePromote), string(whatsmeow.ParticipantChangeDemote)}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t updateParticipantsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if !helpers.Find(actions, t.Action) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Action must be add, remove, promote or demote"))
+			return
+		}
+
+		if len(t.Participants) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Participants in Payload"))
+			return
+		}
+
+		participants, invalid := parseParticipants(t.Participants)
+		if invalid != "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Participant "+invalid))
+			return
+		}
+
+		changes := map[types.JID]whatsmeow.ParticipantChange{}
+		for _, participant := range participants {
+			changes[participant] = whatsmeow.ParticipantChange(t.Action)
+		}
+
+		resp, err := client.UpdateGroupParticipants(group, changes)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to update group participants")
+			msg := fmt.Sprintf("Failed to update group participants: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Str("group", group.String()).Str("action", t.Action).Int("participants", len(participants)).Msg("Group participants updated")
+		response := map[string]interface{}{"Details": "Group participants updated", "Participants": groups.FromUpdate(resp)}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Leave group
+func (s *GroupController) LeaveGroup() http.HandlerFunc {
+
+	type leaveGroupStruct struct {
+		GroupJID string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t leaveGroupStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		err = client.LeaveGroup(group)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to leave group")
+			msg := fmt.Sprintf("Failed to leave group: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Left group successfully"}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// List pending requests to join a group with membership approval on
+func (s *GroupController) GetGroupJoinRequests() http.HandlerFunc {
+
+	type getJoinRequestsStruct struct {
+		GroupJID string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t getJoinRequestsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		requests, err := groups.GetJoinRequests(client, group)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get group join requests: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"GroupJID": group.String(), "Requests": requests}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Approve or reject requests to join a group, either the listed Participants or
+// every pending request when All is set, with the result for each of them
+func (s *GroupController) UpdateGroupJoinRequests() http.HandlerFunc {
+
+	type updateJoinRequestsStruct struct {
+		GroupJID     string
+		Action       string
+		Participants []string
+		All          bool
+	}
+
+	actions := []string{groups.RequestApprove, groups.RequestReject}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t updateJoinRequestsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if !helpers.Find(actions, t.Action) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Action must be approve or reject"))
+			return
+		}
+
+		if t.All == (len(t.Participants) > 0) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Either Participants or All must be in Payload"))
+			return
+		}
+
+		participants, invalid := parseParticipants(t.Participants)
+		if invalid != "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Participant "+invalid))
+			return
+		}
+
+		if t.All {
+			requests, err := groups.GetJoinRequests(client, group)
+			if err != nil {
+				msg := fmt.Sprintf("Failed to get group join requests: %v", err)
+				log.Error().Msg(msg)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			for _, request := range requests {
+				if jid, ok := helpers.ParseJID(request.Jid); ok {
+					participants = append(participants, jid)
+				}
+			}
+		}
+
+		results := []groups.ParticipantResult{}
+		if len(participants) > 0 {
+			results, err = groups.UpdateJoinRequests(client, group, participants, t.Action)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to update group join requests")
+				msg := fmt.Sprintf("Failed to update group join requests: %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+		}
+
+		log.Info().Str("userid", txtid).Str("group", group.String()).Str("action", t.Action).Int("participants", len(participants)).Msg("Group join requests updated")
+		response := map[string]interface{}{"Details": "Group join requests updated", "Participants": results}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Set group membership approval mode, where admins approve whoever asks to join
+func (s *GroupController) SetGroupJoinApproval() http.HandlerFunc {
+
+	type setJoinApprovalStruct struct {
+		GroupJID string
+		Approval *bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := s.Sessions.Client(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t setJoinApprovalStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := helpers.ParseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Approval == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Approval in Payload"))
+			return
+		}
+
+		err = groups.SetJoinApproval(client, group, *t.Approval)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group join approval mode")
+			msg := fmt.Sprintf("Failed to set group join approval mode: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group join approval mode set successfully", "Approval": *t.Approval}
 		responseJson, err := json.Marshal(response)
 
 		if err != nil {
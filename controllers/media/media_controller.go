@@ -0,0 +1,51 @@
+package media
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"wuzapi/internal/controller"
+
+	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+)
+
+type MediaController struct {
+	*controller.Server
+}
+
+// Media links are authorized by their signature, not by a user token
+func (s *MediaController) SignRoutes(c alice.Chain) {
+	s.Router.Handle("/media/{userid:[0-9]+}/{name}", c.Then(s.GetMedia())).Methods("GET")
+}
+
+// Serves a saved media file through a signed link sent in a webhook
+func (s *MediaController) GetMedia() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		vars := mux.Vars(r)
+		txtid := vars["userid"]
+		name := vars["name"]
+		query := r.URL.Query()
+
+		userid, _ := strconv.Atoi(txtid)
+		if filepath.Base(name) != name || name == "." || name == ".." {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Media not found"))
+			return
+		}
+		if !s.Media.Verify(userid, name, query.Get("expires"), query.Get("signature")) {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Invalid or expired media link"))
+			return
+		}
+
+		path := filepath.Join(s.ExPath, "files", "user_"+strconv.Itoa(userid), name)
+		_, err := os.Stat(path)
+		if err != nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Media not found"))
+			return
+		}
+		http.ServeFile(w, r, path)
+	}
+}
@@ -22,11 +22,13 @@ type SessionController struct {
 }
 
 func (s *SessionController) SignRoutes(c alice.Chain) {
-	s.Router.Handle("/session/connect", c.Then(s.Connect())).Methods("POST")
-	s.Router.Handle("/session/disconnect", c.Then(s.Disconnect())).Methods("POST")
-	s.Router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
-	s.Router.Handle("/session/status", c.Then(s.GetStatus())).Methods("GET")
-	s.Router.Handle("/session/qr", c.Then(s.GetQR())).Methods("GET")
+	session := c.Append(s.RequireScope(internalTypes.ScopeSession))
+
+	s.Router.Handle("/session/connect", session.Then(s.Connect())).Methods("POST")
+	s.Router.Handle("/session/disconnect", session.Then(s.Disconnect())).Methods("POST")
+	s.Router.Handle("/session/logout", session.Then(s.Logout())).Methods("POST")
+	s.Router.Handle("/session/status", session.Then(s.GetStatus())).Methods("GET")
+	s.Router.Handle("/session/qr", session.Then(s.GetQR())).Methods("GET")
 }
 
 // Connects to Whatsapp Servers
@@ -42,7 +44,6 @@ func (s *SessionController) Connect() http.HandlerFunc {
 		webhook := r.Context().Value("userinfo").(internalTypes.Values).Get("Webhook")
 		jid := r.Context().Value("userinfo").(internalTypes.Values).Get("Jid")
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
-		token := r.Context().Value("userinfo").(internalTypes.Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 		eventstring := ""
 
@@ -55,7 +56,7 @@ func (s *SessionController) Connect() http.HandlerFunc {
 			return
 		}
 
-		if s.ClientPointer[userid] != nil {
+		if s.Sessions.Client(userid) != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Connected"))
 			return
 		} else {
@@ -83,18 +84,17 @@ func (s *SessionController) Connect() http.HandlerFunc {
 			}
 			log.Info().Str("events", eventstring).Msg("Setting subscribed events")
 			v := helpers.UpdateUserInfo(r.Context().Value("userinfo"), "Events", eventstring)
-			s.UserInfoCache.Set(token, v, cache.NoExpiration)
+			s.UserInfoCache.Set(txtid, v, cache.NoExpiration)
 
 			log.Info().Str("jid", jid).Msg("Attempt to connect")
-			s.KillChannel[userid] = make(chan bool)
-			go s.StartClient(userid, jid, token, subscribedEvents)
+			go s.StartClient(userid, jid, subscribedEvents)
 
 			if t.Immediate == false {
 				log.Warn().Msg("Waiting 10 seconds")
 				time.Sleep(10000 * time.Millisecond)
 
-				if s.ClientPointer[userid] != nil {
-					if !s.ClientPointer[userid].IsConnected() {
+				if client := s.Sessions.Client(userid); client != nil {
+					if !client.IsConnected() {
 						s.Respond(w, r, http.StatusInternalServerError, errors.New("Failed to Connect"))
 						return
 					}
@@ -123,23 +123,23 @@ func (s *SessionController) Disconnect() http.HandlerFunc {
 
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		jid := r.Context().Value("userinfo").(internalTypes.Values).Get("Jid")
-		token := r.Context().Value("userinfo").(internalTypes.Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
-		if s.ClientPointer[userid].IsConnected() == true {
-			if s.ClientPointer[userid].IsLoggedIn() == true {
+		if client.IsConnected() == true {
+			if client.IsLoggedIn() == true {
 				log.Info().Str("jid", jid).Msg("Disconnection successfull")
-				s.KillChannel[userid] <- true
+				s.Sessions.Kill(userid)
 				_, err := s.Db.Exec("UPDATE users SET events=? WHERE id=?", "", userid)
 				if err != nil {
 					log.Warn().Str("userid", txtid).Msg("Could not set events in users table")
 				}
 				v := helpers.UpdateUserInfo(r.Context().Value("userinfo"), "Events", "")
-				s.UserInfoCache.Set(token, v, cache.NoExpiration)
+				s.UserInfoCache.Set(txtid, v, cache.NoExpiration)
 
 				response := map[string]interface{}{"Details": "Disconnected"}
 				responseJson, err := json.Marshal(response)
@@ -170,22 +170,23 @@ func (s *SessionController) Logout() http.HandlerFunc {
 		jid := r.Context().Value("userinfo").(internalTypes.Values).Get("Jid")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		} else {
-			if s.ClientPointer[userid].IsLoggedIn() == true && s.ClientPointer[userid].IsConnected() == true {
-				err := s.ClientPointer[userid].Logout()
+			if client.IsLoggedIn() == true && client.IsConnected() == true {
+				err := client.Logout()
 				if err != nil {
 					log.Error().Str("jid", jid).Msg("Could not perform logout")
 					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
 					return
 				} else {
 					log.Info().Str("jid", jid).Msg("Logged out")
-					s.KillChannel[userid] <- true
+					s.Sessions.Kill(userid)
 				}
 			} else {
-				if s.ClientPointer[userid].IsConnected() == true {
+				if client.IsConnected() == true {
 					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
 					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
 					return
@@ -216,15 +217,20 @@ func (s *SessionController) GetStatus() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+		// Sessions no longer running still report how they ended
+		status := s.Sessions.Status(userid)
+		isConnected := false
+		isLoggedIn := false
+		if client := s.Sessions.Client(userid); client != nil {
+			isConnected = client.IsConnected()
+			isLoggedIn = client.IsLoggedIn()
 		}
 
-		isConnected := s.ClientPointer[userid].IsConnected()
-		isLoggedIn := s.ClientPointer[userid].IsLoggedIn()
-
-		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
+		since := int64(0)
+		if !status.Since.IsZero() {
+			since = status.Since.Unix()
+		}
+		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn, "State": status.State, "Since": since, "LastError": status.LastError, "Attempts": status.Attempts}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -243,11 +249,12 @@ func (s *SessionController) GetQR() http.HandlerFunc {
 		userid, _ := strconv.Atoi(txtid)
 		code := ""
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		} else {
-			if s.ClientPointer[userid].IsConnected() == false {
+			if client.IsConnected() == false {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
 				return
 			}
@@ -269,7 +276,7 @@ func (s *SessionController) GetQR() http.HandlerFunc {
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
-			if s.ClientPointer[userid].IsLoggedIn() == true {
+			if client.IsLoggedIn() == true {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
 				return
 			}
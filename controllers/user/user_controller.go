@@ -21,10 +21,12 @@ type UserController struct {
 }
 
 func (s *UserController) SignRoutes(c alice.Chain) {
-	s.Router.Handle("/user/info", c.Then(s.GetUser())).Methods("GET")
-	s.Router.Handle("/user/check", c.Then(s.CheckUser())).Methods("POST")
-	s.Router.Handle("/user/avatar", c.Then(s.GetAvatar())).Methods("POST")
-	s.Router.Handle("/user/contacts", c.Then(s.GetContacts())).Methods("GET")
+	read := c.Append(s.RequireScope(internalTypes.ScopeRead))
+
+	s.Router.Handle("/user/info", read.Then(s.GetUser())).Methods("GET")
+	s.Router.Handle("/user/check", read.Then(s.CheckUser())).Methods("POST")
+	s.Router.Handle("/user/avatar", read.Then(s.GetAvatar())).Methods("POST")
+	s.Router.Handle("/user/contacts", read.Then(s.GetContacts())).Methods("GET")
 }
 
 // checks if users/phones are on Whatsapp
@@ -50,7 +52,8 @@ func (s *UserController) CheckUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -68,7 +71,7 @@ func (s *UserController) CheckUser() http.HandlerFunc {
 			return
 		}
 
-		resp, err := s.ClientPointer[userid].IsOnWhatsApp(t.Phone)
+		resp, err := client.IsOnWhatsApp(t.Phone)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
 			return
@@ -110,7 +113,8 @@ func (s *UserController) GetUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -136,7 +140,7 @@ func (s *UserController) GetUser() http.HandlerFunc {
 			}
 			jids = append(jids, jid)
 		}
-		resp, err := s.ClientPointer[userid].GetUserInfo(jids)
+		resp, err := client.GetUserInfo(jids)
 
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get user info: %v", err)
@@ -175,7 +179,8 @@ func (s *UserController) GetAvatar() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -202,7 +207,7 @@ func (s *UserController) GetAvatar() http.HandlerFunc {
 		var pic *types.ProfilePictureInfo
 
 		existingID := ""
-		pic, err = s.ClientPointer[userid].GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+		pic, err = client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
 			Preview:    t.Preview,
 			ExistingID: existingID,
 		})
@@ -238,13 +243,14 @@ func (s *UserController) GetContacts() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if s.ClientPointer[userid] == nil {
+		client := s.Sessions.Client(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		result := map[types.JID]types.ContactInfo{}
-		result, err := s.ClientPointer[userid].Store.Contacts.GetAllContacts()
+		result, err := client.Store.Contacts.GetAllContacts()
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
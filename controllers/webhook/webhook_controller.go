@@ -2,25 +2,313 @@ package webhook
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 	"wuzapi/internal/controller"
 	"wuzapi/internal/helpers"
 	internalTypes "wuzapi/internal/types"
+	webhooks "wuzapi/webhook"
 
+	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
 )
 
 type WebhookController struct {
 	*controller.Server
 }
 
-func (s *WebhookController)SignRoutes(c alice.Chain) {
-	s.Router.Handle("/webhook", c.Then(s.SetWebhook())).Methods("POST")
-	s.Router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
+func (s *WebhookController) SignRoutes(c alice.Chain) {
+	webhook := c.Append(s.RequireScope(internalTypes.ScopeWebhook))
+
+	s.Router.Handle("/webhook", webhook.Then(s.SetWebhook())).Methods("POST")
+	s.Router.Handle("/webhook", webhook.Then(s.GetWebhook())).Methods("GET")
+	s.Router.Handle("/webhook/endpoints", webhook.Then(s.ListEndpoints())).Methods("GET")
+	s.Router.Handle("/webhook/endpoints", webhook.Then(s.CreateEndpoint())).Methods("POST")
+	s.Router.Handle("/webhook/endpoints/{id:[0-9]+}", webhook.Then(s.GetEndpoint())).Methods("GET")
+	s.Router.Handle("/webhook/endpoints/{id:[0-9]+}", webhook.Then(s.UpdateEndpoint())).Methods("PUT")
+	s.Router.Handle("/webhook/endpoints/{id:[0-9]+}", webhook.Then(s.DeleteEndpoint())).Methods("DELETE")
+}
+
+// Fields accepted when creating or updating an endpoint, nil fields are left unchanged
+type endpointStruct struct {
+	Url     *string
+	Events  []string
+	Chats   []string
+	Enabled *bool
+	Headers map[string]string
+	Format  *string
+	Media   *string
+	Subject *string
+}
+
+// Validates and applies request fields to an endpoint
+func (t *endpointStruct) apply(e *webhooks.Endpoint) error {
+	if t.Url != nil {
+		u, err := url.Parse(*t.Url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && !webhooks.IsBroker(*t.Url)) || u.Host == "" {
+			return errors.New("Url must be a valid http, https, nats, amqp or redis URL")
+		}
+		e.Url = *t.Url
+	}
+	if t.Events != nil {
+		events := []string{}
+		for _, event := range t.Events {
+			if !helpers.Find(internalTypes.MessageTypes, event) {
+				return fmt.Errorf("Invalid event type: %s", event)
+			}
+			if !helpers.Find(events, event) {
+				events = append(events, event)
+			}
+		}
+		if len(events) == 0 {
+			events = append(events, "All")
+		}
+		e.Events = events
+	}
+	if t.Chats != nil {
+		chats := []string{}
+		for _, chat := range t.Chats {
+			jid, ok := helpers.ParseJID(chat)
+			if !ok {
+				return fmt.Errorf("Could not parse chat: %s", chat)
+			}
+			if !helpers.Find(chats, jid.String()) {
+				chats = append(chats, jid.String())
+			}
+		}
+		e.Chats = chats
+	}
+	if t.Enabled != nil {
+		e.Enabled = *t.Enabled
+	}
+	if t.Headers != nil {
+		for name := range t.Headers {
+			canonical := http.CanonicalHeaderKey(name)
+			if canonical == "Content-Type" || canonical == "Content-Length" || strings.HasPrefix(canonical, "X-Wuzapi-") {
+				return fmt.Errorf("Header can not be overridden: %s", name)
+			}
+		}
+		e.Headers = t.Headers
+	}
+	if t.Format != nil {
+		if *t.Format != webhooks.FormatForm && *t.Format != webhooks.FormatJSON {
+			return errors.New("Format must be form or json")
+		}
+		e.Format = *t.Format
+	}
+	if t.Media != nil {
+		if *t.Media != webhooks.MediaMultipart && *t.Media != webhooks.MediaBase64 && *t.Media != webhooks.MediaURL {
+			return errors.New("Media must be multipart, base64 or url")
+		}
+		e.Media = *t.Media
+	}
+	if t.Subject != nil {
+		if strings.TrimSpace(*t.Subject) == "" {
+			return errors.New("Subject can not be empty")
+		}
+		e.Subject = *t.Subject
+	}
+	if webhooks.IsBroker(e.Url) {
+		if e.Format != webhooks.FormatJSON {
+			return errors.New("Broker endpoints only support the json format")
+		}
+		if e.Media == webhooks.MediaMultipart {
+			return errors.New("Broker endpoints only support base64 or url media")
+		}
+		if e.Subject == "" {
+			e.Subject = webhooks.DefaultSubject
+		}
+	}
+	return nil
+}
+
+// Lists webhook endpoints
+func (s *WebhookController) ListEndpoints() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		list, err := webhooks.ListEndpoints(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not list webhook endpoints: %v", err))
+			return
+		}
+
+		response := map[string]interface{}{"Endpoints": list}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets a webhook endpoint
+func (s *WebhookController) GetEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		e, err := webhooks.GetEndpoint(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook endpoint: %v", err))
+			return
+		}
+		if e == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			return
+		}
+
+		responseJson, err := json.Marshal(e)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Adds a webhook endpoint, by default enabled for all events and chats
+func (s *WebhookController) CreateEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t endpointStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Url == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Url in Payload"))
+			return
+		}
+
+		e := webhooks.Endpoint{UserId: userid, Events: []string{"All"}, Chats: []string{}, Enabled: true, Headers: map[string]string{}, Format: webhooks.FormatForm, Media: webhooks.MediaMultipart}
+		if webhooks.IsBroker(*t.Url) {
+			e.Format = webhooks.FormatJSON
+			e.Media = webhooks.MediaBase64
+		}
+		err = t.apply(&e)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		err = webhooks.CreateEndpoint(s.Db, &e)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not create webhook endpoint: %v", err))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("endpoint", e.Id).Str("url", e.Url).Msg("Webhook endpoint created")
+		responseJson, err := json.Marshal(e)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusCreated, string(responseJson))
+		}
+		return
+	}
+}
+
+// Changes the fields present in the payload of a webhook endpoint
+func (s *WebhookController) UpdateEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		decoder := json.NewDecoder(r.Body)
+		var t endpointStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		e, err := webhooks.GetEndpoint(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook endpoint: %v", err))
+			return
+		}
+		if e == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			return
+		}
+
+		err = t.apply(e)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		found, err := webhooks.UpdateEndpoint(s.Db, e)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not update webhook endpoint: %v", err))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("endpoint", e.Id).Msg("Webhook endpoint updated")
+		responseJson, err := json.Marshal(e)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Deletes a webhook endpoint
+func (s *WebhookController) DeleteEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+		found, err := webhooks.DeleteEndpoint(s.Db, userid, id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not delete webhook endpoint: %v", err))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("endpoint", id).Msg("Webhook endpoint deleted")
+		response := map[string]interface{}{"Details": "Webhook endpoint deleted", "Id": id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
 }
 
 // Gets WebHook
@@ -29,16 +317,18 @@ func (s *WebhookController) GetWebhook() http.HandlerFunc {
 
 		webhook := ""
 		events := ""
+		format := ""
+		media := ""
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
 
-		rows, err := s.Db.Query("SELECT webhook,events FROM users WHERE id=? LIMIT 1", txtid)
+		rows, err := s.Db.Query("SELECT webhook,events,webhook_format,webhook_media FROM users WHERE id=? LIMIT 1", txtid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook: %v", err))
 			return
 		}
 		defer rows.Close()
 		for rows.Next() {
-			err = rows.Scan(&webhook, &events)
+			err = rows.Scan(&webhook, &events, &format, &media)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook: %s", fmt.Sprintf("%s", err)))
 				return
@@ -52,7 +342,19 @@ func (s *WebhookController) GetWebhook() http.HandlerFunc {
 
 		eventarray := strings.Split(events, ",")
 
-		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray}
+		userid, _ := strconv.Atoi(txtid)
+		secrets, err := webhooks.ActiveSecrets(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook: %v", err))
+			return
+		}
+		previousExpires, err := webhooks.PreviousSecretExpires(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not get webhook: %v", err))
+			return
+		}
+
+		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray, "signed": len(secrets) > 0, "previous_secret_expires": previousExpires, "format": format, "media": media}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -66,12 +368,19 @@ func (s *WebhookController) GetWebhook() http.HandlerFunc {
 // Sets WebHook
 func (s *WebhookController) SetWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		WebhookURL string
+		// Unchanged if left out, so secrets and formats can be changed alone
+		WebhookURL *string
+		// New signing secret, the current one stays valid for SecretGracePeriod seconds
+		Secret            string
+		SecretGracePeriod *int64
+		RemoveSecret      bool
+		// Delivery format and media mode, unchanged if empty
+		Format string
+		Media  string
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
-		token := r.Context().Value("userinfo").(internalTypes.Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
 		decoder := json.NewDecoder(r.Body)
@@ -81,18 +390,74 @@ func (s *WebhookController) SetWebhook() http.HandlerFunc {
 			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set webhook: %v", err))
 			return
 		}
-		var webhook = t.WebhookURL
+		webhook := r.Context().Value("userinfo").(internalTypes.Values).Get("Webhook")
+		if t.WebhookURL != nil {
+			webhook = *t.WebhookURL
+		}
+		if webhooks.IsBroker(webhook) {
+			s.Respond(w, r, http.StatusBadRequest, webhooks.ErrBrokerWebhook)
+			return
+		}
+
+		if t.Secret != "" && len(t.Secret) < 16 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Secret must be at least 16 characters long"))
+			return
+		}
+		grace := int64(86400)
+		if t.SecretGracePeriod != nil {
+			grace = *t.SecretGracePeriod
+		}
+		if grace < 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("SecretGracePeriod can not be negative"))
+			return
+		}
+
+		if t.Format != "" && t.Format != webhooks.FormatForm && t.Format != webhooks.FormatJSON {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Format must be form or json"))
+			return
+		}
+		if t.Media != "" && t.Media != webhooks.MediaMultipart && t.Media != webhooks.MediaBase64 && t.Media != webhooks.MediaURL {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Media must be multipart, base64 or url"))
+			return
+		}
 
-		_, err = s.Db.Exec("UPDATE users SET webhook=? WHERE id=?", webhook, userid)
+		if t.WebhookURL != nil {
+			_, err = s.Db.Exec("UPDATE users SET webhook=? WHERE id=?", webhook, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("%s", err))
+				return
+			}
+		}
+		if t.Format != "" {
+			_, err = s.Db.Exec("UPDATE users SET webhook_format=? WHERE id=?", t.Format, userid)
+		}
+		if err == nil && t.Media != "" {
+			_, err = s.Db.Exec("UPDATE users SET webhook_media=? WHERE id=?", t.Media, userid)
+		}
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("%s", err))
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set webhook format: %v", err))
 			return
 		}
 
 		v := helpers.UpdateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
-		s.UserInfoCache.Set(token, v, cache.NoExpiration)
+		s.UserInfoCache.Set(txtid, v, cache.NoExpiration)
+
+		if t.RemoveSecret {
+			err = webhooks.RemoveSecrets(s.Db, userid)
+		} else if t.Secret != "" {
+			err = webhooks.RotateSecret(s.Db, userid, t.Secret, time.Duration(grace)*time.Second)
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set webhook secret: %v", err))
+			return
+		}
+		secrets, err := webhooks.ActiveSecrets(s.Db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not set webhook secret: %v", err))
+			return
+		}
 
-		response := map[string]interface{}{"webhook": webhook}
+		response := map[string]interface{}{"webhook": webhook, "signed": len(secrets) > 0}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
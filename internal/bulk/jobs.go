@@ -0,0 +1,223 @@
+package bulk
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+	"wuzapi/internal/sendqueue"
+)
+
+const (
+	// Job statuses
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusCancelled = "cancelled"
+
+	// Recipient statuses besides the send queue ones
+	StatusInvalid       = "invalid"
+	StatusNotOnWhatsapp = "not_on_whatsapp"
+)
+
+// A message sent to a list of recipients
+type Job struct {
+	Id     int64
+	UserId int
+	Name   string
+	// Message type: text, image, video, document or audio
+	Type   string
+	Total  int
+	Status string
+	// Recipients by status: invalid, not_on_whatsapp, pending, sent, failed or cancelled
+	Counts  map[string]int
+	Created int64
+}
+
+// A recipient of a job and how sending to it went
+type Recipient struct {
+	Phone     string
+	Jid       string
+	Variables map[string]string
+	Status    string
+	QueueId   int64
+	MessageId string
+	Error     string
+	Sent      int64
+}
+
+// Stores a job and its recipients, returns the ids of the recipients
+func Create(db *sql.DB, job *Job, recipients []Recipient) ([]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job.Status = StatusRunning
+	job.Total = len(recipients)
+	job.Created = time.Now().Unix()
+	res, err := tx.Exec("INSERT INTO bulk_jobs (user_id,name,type,total,status,created) VALUES (?,?,?,?,?,?)", job.UserId, job.Name, job.Type, job.Total, job.Status, job.Created)
+	if err != nil {
+		return nil, err
+	}
+	job.Id, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO bulk_recipients (job_id,user_id,phone,jid,variables,status,message_id,error) VALUES (?,?,?,?,?,?,?,?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	ids := make([]int64, len(recipients))
+	for i, rc := range recipients {
+		variables, _ := json.Marshal(rc.Variables)
+		res, err = stmt.Exec(job.Id, job.UserId, rc.Phone, rc.Jid, string(variables), rc.Status, rc.MessageId, rc.Error)
+		if err != nil {
+			return nil, err
+		}
+		ids[i], err = res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// Records the send queue item of a recipient, or why it could not be queued
+func SetQueued(db *sql.DB, id int64, queueId int64, queueErr error) error {
+	if queueErr != nil {
+		_, err := db.Exec("UPDATE bulk_recipients SET status=?, error=? WHERE id=?", sendqueue.StatusFailed, queueErr.Error(), id)
+		return err
+	}
+	_, err := db.Exec("UPDATE bulk_recipients SET queue_id=? WHERE id=?", queueId, id)
+	return err
+}
+
+// Updates the recipient of a send queue item once it is sent, failed or cancelled.
+// Recipients are matched by message id, which they get before being queued.
+func Finished(db *sql.DB, item *sendqueue.Item) error {
+	_, err := db.Exec("UPDATE bulk_recipients SET status=?, error=?, sent=? WHERE user_id=? AND message_id=?", item.Status, item.Error, item.Sent, item.UserId, item.MessageId)
+	return err
+}
+
+// Gets a job with its counts, returns nil if there is none
+func Get(db *sql.DB, userid int, id int64) (*Job, error) {
+	job := Job{}
+	err := db.QueryRow("SELECT "+jobColumns+" FROM bulk_jobs WHERE user_id=? AND id=?", userid, id).Scan(&job.Id, &job.UserId, &job.Name, &job.Type, &job.Total, &job.Status, &job.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, count(db, &job)
+}
+
+// Lists jobs with their counts, newest first, before an id if set
+func List(db *sql.DB, userid int, before int64, limit int) ([]Job, error) {
+	query := "SELECT " + jobColumns + " FROM bulk_jobs WHERE user_id=?"
+	args := []interface{}{userid}
+	if before > 0 {
+		query += " AND id<?"
+		args = append(args, before)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	list := []Job{}
+	for rows.Next() {
+		job := Job{}
+		err = rows.Scan(&job.Id, &job.UserId, &job.Name, &job.Type, &job.Total, &job.Status, &job.Created)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		err = count(db, &list[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Counts the recipients of a job by status, a running job is done once none is pending
+func count(db *sql.DB, job *Job) error {
+	rows, err := db.Query("SELECT status, COUNT(*) FROM bulk_recipients WHERE job_id=? GROUP BY status", job.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	job.Counts = map[string]int{sendqueue.StatusPending: 0, sendqueue.StatusSent: 0, sendqueue.StatusFailed: 0}
+	for rows.Next() {
+		status := ""
+		n := 0
+		err = rows.Scan(&status, &n)
+		if err != nil {
+			return err
+		}
+		job.Counts[status] = n
+	}
+	if job.Status == StatusRunning && job.Counts[sendqueue.StatusPending] == 0 {
+		job.Status = StatusDone
+	}
+	return rows.Err()
+}
+
+// Gets the recipients of a job in the order they were given
+func Recipients(db *sql.DB, jobid int64) ([]Recipient, error) {
+	rows, err := db.Query("SELECT phone,jid,variables,status,queue_id,message_id,error,sent FROM bulk_recipients WHERE job_id=? ORDER BY id", jobid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []Recipient{}
+	for rows.Next() {
+		rc := Recipient{}
+		variables := ""
+		err = rows.Scan(&rc.Phone, &rc.Jid, &variables, &rc.Status, &rc.QueueId, &rc.MessageId, &rc.Error, &rc.Sent)
+		if err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(variables), &rc.Variables)
+		list = append(list, rc)
+	}
+	return list, rows.Err()
+}
+
+// Marks a job cancelled, returns the send queue items of its recipients still pending
+func Cancel(db *sql.DB, userid int, id int64) ([]int64, error) {
+	_, err := db.Exec("UPDATE bulk_jobs SET status=? WHERE user_id=? AND id=?", StatusCancelled, userid, id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT queue_id FROM bulk_recipients WHERE job_id=? AND status=? AND queue_id>0", id, sendqueue.StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		queueId := int64(0)
+		err = rows.Scan(&queueId)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, queueId)
+	}
+	return ids, rows.Err()
+}
+
+const jobColumns = "id,user_id,name,type,total,status,created"
@@ -2,7 +2,7 @@ package controller
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
@@ -12,11 +12,17 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"wuzapi/internal/helpers"
+	"wuzapi/internal/outbound"
+	"wuzapi/internal/scheduler"
+	"wuzapi/internal/sendqueue"
+	"wuzapi/internal/sessions"
+	"wuzapi/internal/stream"
 	internalTypes "wuzapi/internal/types"
+	"wuzapi/webhook"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/gorilla/mux"
 	"github.com/mdp/qrterminal"
 	"github.com/patrickmn/go-cache"
@@ -29,17 +35,26 @@ import (
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
+var devicePropsOnce sync.Once
+
 type Server struct {
 	Db            *sql.DB
 	Router        *mux.Router
 	ExPath        string
-	ClientPointer map[int]*whatsmeow.Client
-	KillChannel   map[int](chan bool)
+	Sessions      *sessions.Registry
 	UserInfoCache *cache.Cache
 	Container     *sqlstore.Container
 	WaDebug       *string
-	ClientHttp    map[int]*resty.Client
 	LogType       *string
+	AdminToken    *string
+	Outbox        *webhook.Outbox
+	Media         *webhook.MediaSigner
+	Stream        *stream.Hub
+	Consumers     *outbound.Manager
+	SendQueue     *sendqueue.Queue
+	Scheduler     *scheduler.Scheduler
+	// Handlers of the /chat/send endpoints by message type, used for messages consumed from brokers
+	SendHandlers map[string]http.HandlerFunc
 }
 
 // Writes JSON response to API clients
@@ -69,7 +84,7 @@ func (s *Server) Respond(w http.ResponseWriter, r *http.Request, status int, dat
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
 func (s *Server) ConnectOnStartup() {
-	rows, err := s.Db.Query("SELECT id,token,jid,webhook,events FROM users WHERE connected=1")
+	rows, err := s.Db.Query("SELECT id,jid,webhook,events,expiration FROM users WHERE connected=1")
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -77,24 +92,27 @@ func (s *Server) ConnectOnStartup() {
 	defer rows.Close()
 	for rows.Next() {
 		txtid := ""
-		token := ""
 		jid := ""
 		webhook := ""
 		events := ""
-		err = rows.Scan(&txtid, &token, &jid, &webhook, &events)
+		var expiration sql.NullInt64
+		err = rows.Scan(&txtid, &jid, &webhook, &events, &expiration)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
 			return
+		} else if helpers.IsExpired(strconv.FormatInt(expiration.Int64, 10)) {
+			log.Warn().Str("userid", txtid).Msg("Skipping connect on startup as user is expired")
+			continue
 		} else {
-			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
-			v := internalTypes.Values{map[string]string{
-				"Id":      txtid,
-				"Jid":     jid,
-				"Webhook": webhook,
-				"Token":   token,
-				"Events":  events,
+			log.Info().Str("userid", txtid).Msg("Connect to Whatsapp on startup")
+			v := internalTypes.Values{M: map[string]string{
+				"Id":         txtid,
+				"Jid":        jid,
+				"Webhook":    webhook,
+				"Events":     events,
+				"Expiration": strconv.FormatInt(expiration.Int64, 10),
 			}}
-			s.UserInfoCache.Set(token, v, cache.NoExpiration)
+			s.UserInfoCache.Set(txtid, v, cache.NoExpiration)
 			userid, _ := strconv.Atoi(txtid)
 			// Gets and set subscription to webhook events
 			eventarray := strings.Split(events, ",")
@@ -117,8 +135,7 @@ func (s *Server) ConnectOnStartup() {
 			}
 			eventstring := strings.Join(subscribedEvents, ",")
 			log.Info().Str("events", eventstring).Str("jid", jid).Msg("Attempt to connect")
-			s.KillChannel[userid] = make(chan bool)
-			go s.StartClient(userid, jid, token, subscribedEvents)
+			go s.StartClient(userid, jid, subscribedEvents)
 		}
 	}
 	err = rows.Err()
@@ -127,20 +144,18 @@ func (s *Server) ConnectOnStartup() {
 	}
 }
 
-func (s *Server) StartClient(userID int, textjid string, token string, subscriptions []string) {
+func (s *Server) StartClient(userID int, textjid string, subscriptions []string) {
 
 	log.Info().Str("userid", strconv.Itoa(userID)).Str("jid", textjid).Msg("Starting websocket connection to Whatsapp")
 
 	var deviceStore *store.Device
 	var err error
 
-	if s.ClientPointer[userID] != nil {
-		isConnected := s.ClientPointer[userID].IsConnected()
-		if isConnected == true {
-			return
-		}
+	// A running supervisor keeps reconnecting on its own
+	if _, running := s.Sessions.Get(userID); running {
+		log.Info().Str("userid", strconv.Itoa(userID)).Msg("Session already running")
+		return
 	}
-
 	/*  container is initialized on main to have just one connection and avoid sqlite locks
 
 		dbDirectory := "dbdata"
@@ -171,7 +186,9 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 		//deviceStore, err := container.GetFirstDevice()
 		deviceStore, err = s.Container.GetDevice(jid)
 		if err != nil {
-			panic(err)
+			log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not get device from store")
+			s.Sessions.Fail(userID, err)
+			return
 		}
 	} else {
 		log.Warn().Msg("No jid found. Creating new device")
@@ -186,9 +203,12 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 	//store.CompanionProps.PlatformType = waProto.CompanionProps_CHROME.Enum()
 	//store.CompanionProps.Os = proto.String("Mac OS")
 
-	osName := "Mac OS 10"
-	store.DeviceProps.PlatformType = waProto.DeviceProps_UNKNOWN.Enum()
-	store.DeviceProps.Os = &osName
+	// Device props are global to whatsmeow, set them only once
+	devicePropsOnce.Do(func() {
+		osName := "Mac OS 10"
+		store.DeviceProps.PlatformType = waProto.DeviceProps_UNKNOWN.Enum()
+		store.DeviceProps.Os = &osName
+	})
 
 	var client *whatsmeow.Client
 	if *s.WaDebug == "DEBUG" {
@@ -196,45 +216,52 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 			deviceStore,
 			waLog.Stdout("Client", "DEBUG", true),
 		)
-		s.ClientHttp[userID].SetDebug(true)
 	} else {
-		s.ClientHttp[userID].SetDebug(false)
 		client = whatsmeow.NewClient(deviceStore, nil)
 	}
 
-	s.ClientPointer[userID] = client
+	sess := sessions.NewSession(userID)
+	sess.Client = client
+	sess.SetSubscriptions(subscriptions)
+	if !s.Sessions.Register(sess) {
+		log.Info().Str("userid", strconv.Itoa(userID)).Msg("Session already running")
+		return
+	}
+	ctx := sess.Context()
 
 	mycli := helpers.MyClient{
 		WAClient:       client,
 		EventHandlerID: 1,
 		UserID:         userID,
-		Token:          token,
-		Subscriptions:  subscriptions,
 		UserInfoCache:  s.UserInfoCache,
-		KillChannel:    s.KillChannel,
+		Sessions:       s.Sessions,
+		Session:        sess,
+		Outbox:         s.Outbox,
+		Media:          s.Media,
+		Stream:         s.Stream,
 		Db:             s.Db,
 	}
 	mycli.EventHandlerID = mycli.WAClient.AddEventHandler(mycli.MyEventHandler)
-	s.ClientHttp[userID] = resty.New()
-	s.ClientHttp[userID].SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
 
-	s.ClientHttp[userID].SetTimeout(5 * time.Second)
-	s.ClientHttp[userID].SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	// Messages queued here or on a broker are sent while the session is up
+	s.StartSendQueue(ctx, userID)
+	s.StartConsumer(ctx, userID)
 
 	if client.Store.ID == nil {
 		// No ID stored, new login
 
-		qrChan, err := client.GetQRChannel(context.Background())
+		qrChan, err := client.GetQRChannel(ctx)
 		if err != nil {
-			// This error means that we're already logged in, so ignore it.
-			if !errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
+			// This error means that we're already logged in, so just connect.
+			if errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
+				s.connectWithBackoff(sess)
+			} else {
 				log.Error().Err(err).Msg("Failed to get QR channel")
+				sess.SetState(sessions.StateFailed, err)
+				sess.Stop()
 			}
-		} else {
-			err = client.Connect() // Si no conectamos no se puede generar QR
-			if err != nil {
-				panic(err)
-			}
+		} else if s.connectWithBackoff(sess) { // Si no conectamos no se puede generar QR
+			sess.SetState(sessions.StatePairing, nil)
 			for evt := range qrChan {
 				if evt.Event == "code" {
 					// Display QR code in terminal (useful for testing/developing)
@@ -257,9 +284,9 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 					if err != nil {
 						log.Error().Err(err).Msg(sqlStmt)
 					}
-					log.Warn().Msg("QR timeout killing channel")
-					delete(s.ClientPointer, userID)
-					s.KillChannel[userID] <- true
+					log.Warn().Msg("QR timeout stopping session")
+					sess.SetState(sessions.StateFailed, errors.New("QR code timeout"))
+					sess.Stop()
 				} else if evt.Event == "success" {
 					log.Info().Msg("QR pairing ok!")
 					// Clear QR code after pairing
@@ -268,6 +295,14 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 					if err != nil {
 						log.Error().Err(err).Msg(sqlStmt)
 					}
+					sess.SetState(sessions.StateConnecting, nil)
+				} else if evt.Event == "error" || strings.HasPrefix(evt.Event, "err-") {
+					log.Error().Err(evt.Error).Str("event", evt.Event).Msg("Pairing failed")
+					if evt.Error == nil {
+						evt.Error = errors.New(evt.Event)
+					}
+					sess.SetState(sessions.StateFailed, evt.Error)
+					sess.Stop()
 				} else {
 					log.Info().Str("event", evt.Event).Msg("Login event")
 				}
@@ -277,85 +312,98 @@ func (s *Server) StartClient(userID int, textjid string, token string, subscript
 	} else {
 		// Already logged in, just connect
 		log.Info().Msg("Already logged in, just connect")
-		err = client.Connect()
-		if err != nil {
-			panic(err)
-		}
+		s.connectWithBackoff(sess)
 	}
 
 	// Keep connected client live until disconnected/killed
+	<-ctx.Done()
+	log.Info().Str("userid", strconv.Itoa(userID)).Msg("Received kill signal")
+	client.RemoveEventHandler(mycli.EventHandlerID)
+	client.Disconnect()
+	if state := sess.Status().State; state != sessions.StateLoggedOut && state != sessions.StateFailed {
+		sess.SetState(sessions.StateDisconnected, nil)
+	}
+	s.Sessions.RemoveIf(sess)
+	sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
+	_, err = s.Db.Exec(sqlStmt, userID)
+	if err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+// Connects a session client, retrying with exponential backoff until it succeeds or the session is stopped
+func (s *Server) connectWithBackoff(sess *sessions.Session) bool {
+	ctx := sess.Context()
 	for {
+		sess.SetState(sessions.StateConnecting, nil)
+		err := sess.Client.Connect()
+		if err == nil {
+			return true
+		}
+		attempts := sess.Failed(err)
+		delay := connectBackoff(attempts)
+		log.Warn().Err(err).Str("userid", strconv.Itoa(sess.UserID)).Int("attempt", attempts).Str("retry_in", delay.String()).Msg("Could not connect to Whatsapp")
 		select {
-		case <-s.KillChannel[userID]:
-			log.Info().Str("userid", strconv.Itoa(userID)).Msg("Received kill signal")
-			client.Disconnect()
-			delete(s.ClientPointer, userID)
-			sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
-			_, err := s.Db.Exec(sqlStmt, userID)
-			if err != nil {
-				log.Error().Err(err).Msg(sqlStmt)
-			}
-			return
-		default:
-			time.Sleep(1000 * time.Millisecond)
-			//log.Info().Str("jid",textjid).Msg("Loop the loop")
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
 		}
 	}
 }
 
-func (s *Server) Authalice(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		var ctx context.Context
-		userid := 0
-		txtid := ""
-		webhook := ""
-		jid := ""
-		events := ""
+// Delay before the next connection attempt, doubling from one second up to five minutes
+func connectBackoff(attempts int) time.Duration {
+	delay := time.Second
+	for i := 1; i < attempts && delay < 5*time.Minute; i++ {
+		delay *= 2
+	}
+	if delay > 5*time.Minute {
+		delay = 5 * time.Minute
+	}
+	return delay
+}
 
-		// Get token from headers or uri parameters
-		token := r.Header.Get("token")
-		if token == "" {
-			token = strings.Join(r.URL.Query()["token"], "")
+// Disconnects sessions of users whose expiration has passed, checking every interval
+func (s *Server) SweepExpiredUsers(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rows, err := s.Db.Query("SELECT id FROM users WHERE expiration>0 AND expiration<=?", time.Now().Unix())
+		if err != nil {
+			log.Error().Err(err).Msg("DB Problem")
+			continue
 		}
-
-		myuserinfo, found := s.UserInfoCache.Get(token)
-		if !found {
-			log.Info().Msg("Looking for user information in DB")
-			// Checks DB from matching user and store user values in context
-			rows, err := s.Db.Query("SELECT id,webhook,jid,events FROM users WHERE token=? LIMIT 1", token)
+		var expired []int
+		for rows.Next() {
+			userid := 0
+			err = rows.Scan(&userid)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
+				log.Error().Err(err).Msg("DB Problem")
+				break
 			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&txtid, &webhook, &jid, &events)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				userid, _ = strconv.Atoi(txtid)
-				v := internalTypes.Values{map[string]string{
-					"Id":      txtid,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Events":  events,
-				}}
-
-				s.UserInfoCache.Set(token, v, cache.NoExpiration)
-				ctx = context.WithValue(r.Context(), "userinfo", v)
+			expired = append(expired, userid)
+		}
+		rows.Close()
+
+		for _, userid := range expired {
+			if s.Sessions.Kill(userid) {
+				log.Info().Str("userid", strconv.Itoa(userid)).Msg("User expired, disconnecting session")
 			}
-		} else {
-			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
-			userid, _ = strconv.Atoi(myuserinfo.(internalTypes.Values).Get("Id"))
 		}
+	}
+}
 
-		if userid == 0 {
-			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
+func (s *Server) Authalice(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		userinfo, tokeninfo, status, err := s.authenticate(r)
+		if err != nil {
+			s.Respond(w, r, status, err)
 			return
 		}
+
+		ctx := context.WithValue(r.Context(), "userinfo", userinfo)
+		ctx = context.WithValue(ctx, "tokeninfo", tokeninfo)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -364,12 +412,40 @@ func (s *Server) Authalice(next http.Handler) http.Handler {
 func (s *Server) Auth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		var ctx context.Context
-		userid := 0
-		txtid := ""
-		webhook := ""
-		jid := ""
-		events := ""
+		userinfo, tokeninfo, status, err := s.authenticate(r)
+		if err != nil {
+			s.Respond(w, r, status, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "userinfo", userinfo)
+		ctx = context.WithValue(ctx, "tokeninfo", tokeninfo)
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// Middleware: Reject requests made with a token that lacks the given scope
+func (s *Server) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokeninfo, ok := r.Context().Value("tokeninfo").(internalTypes.Values)
+			if !ok || !HasScope(tokeninfo.Get("Scopes"), scope) {
+				s.Respond(w, r, http.StatusForbidden, fmt.Errorf("Token lacks scope: %s", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Middleware: Authenticate admin connections based on the admin token set at startup
+func (s *Server) AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if s.AdminToken == nil || *s.AdminToken == "" {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Admin API disabled"))
+			return
+		}
 
 		// Get token from headers or uri parameters
 		token := r.Header.Get("token")
@@ -377,43 +453,10 @@ func (s *Server) Auth(handler http.HandlerFunc) http.HandlerFunc {
 			token = strings.Join(r.URL.Query()["token"], "")
 		}
 
-		myuserinfo, found := s.UserInfoCache.Get(token)
-		if !found {
-			log.Info().Msg("Looking for user information in DB")
-			// Checks DB from matching user and store user values in context
-			rows, err := s.Db.Query("SELECT id,webhook,jid,events FROM users WHERE token=? LIMIT 1", token)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&txtid, &webhook, &jid, &events)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-				userid, _ = strconv.Atoi(txtid)
-				v := internalTypes.Values{map[string]string{
-					"Id":      txtid,
-					"Jid":     jid,
-					"Webhook": webhook,
-					"Token":   token,
-					"Events":  events,
-				}}
-
-				s.UserInfoCache.Set(token, v, cache.NoExpiration)
-				ctx = context.WithValue(r.Context(), "userinfo", v)
-			}
-		} else {
-			ctx = context.WithValue(r.Context(), "userinfo", myuserinfo)
-			userid, _ = strconv.Atoi(myuserinfo.(internalTypes.Values).Get("Id"))
-		}
-
-		if userid == 0 {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*s.AdminToken)) != 1 {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
 			return
 		}
-		handler(w, r.WithContext(ctx))
-	}
+		next.ServeHTTP(w, r)
+	})
 }
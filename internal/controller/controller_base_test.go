@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"wuzapi/internal/outbound"
+	"wuzapi/internal/schema"
+	"wuzapi/internal/sendqueue"
+	"wuzapi/internal/sessions"
+	"wuzapi/internal/stream"
+
+	"github.com/patrickmn/go-cache"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+	_ "modernc.org/sqlite"
+)
+
+func newTestServer(t *testing.T) *Server {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "users.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = schema.Create(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := sqlstore.New("sqlite", "file:"+filepath.Join(dir, "main.db")+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waDebug := ""
+	logType := "json"
+	return &Server{
+		Db:            db,
+		Sessions:      sessions.NewRegistry(),
+		UserInfoCache: cache.New(5*time.Minute, 10*time.Minute),
+		Container:     container,
+		WaDebug:       &waDebug,
+		LogType:       &logType,
+		Stream:        stream.NewHub(10),
+		Consumers:     outbound.NewManager(db),
+		SendQueue:     sendqueue.NewQueue(db),
+	}
+}
+
+// Runs connects, disconnects and sends for the same users at once, run with -race
+// to catch unsynchronized access to sessions. There is no network in tests, so
+// sessions keep retrying to connect until they are killed.
+func TestConcurrentConnectDisconnectSend(t *testing.T) {
+	s := newTestServer(t)
+	users := []int{1, 2, 3}
+	for _, userid := range users {
+		_, err := s.Db.Exec("INSERT INTO users (id,name,token) VALUES (?,?,'')", userid, fmt.Sprintf("user%d", userid))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipient := types.NewJID("5491155554444", types.DefaultUserServer)
+	msg := &waProto.Message{Conversation: proto.String("hello")}
+
+	var clients sync.WaitGroup
+	var workers sync.WaitGroup
+	var mu sync.Mutex
+	queued := map[int]int{}
+	for round := 0; round < 20; round++ {
+		for _, userid := range users {
+			clients.Add(1)
+			go func(userid int) {
+				defer clients.Done()
+				s.StartClient(userid, "", []string{"All"})
+			}(userid)
+
+			workers.Add(2)
+			go func(userid int) {
+				defer workers.Done()
+				s.Sessions.Kill(userid)
+				s.Sessions.Status(userid)
+			}(userid)
+			go func(userid int, round int) {
+				defer workers.Done()
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/chat/send/text", nil)
+				s.QueueMessage(w, r, userid, recipient, fmt.Sprintf("TEST%04d%04d", userid, round), "text", msg)
+				if w.Code != http.StatusAccepted {
+					t.Errorf("queueing for user %d got %d: %s", userid, w.Code, w.Body.String())
+					return
+				}
+				mu.Lock()
+				queued[userid]++
+				mu.Unlock()
+			}(userid, round)
+		}
+	}
+	workers.Wait()
+
+	// Clients started after the last kill keep running until killed. Queue workers of killed
+	// sessions may still be putting back an item they could not send, it counts as pending.
+	done := make(chan struct{})
+	go func() {
+		clients.Wait()
+		close(done)
+	}()
+	deadline := time.After(30 * time.Second)
+	for stopped := false; !stopped; {
+		for _, userid := range users {
+			s.Sessions.Kill(userid)
+		}
+		select {
+		case <-done:
+			stopped = true
+		case <-deadline:
+			t.Fatal("sessions did not stop")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	for _, userid := range users {
+		if client := s.Sessions.Client(userid); client != nil {
+			t.Errorf("user %d still has a session", userid)
+		}
+		items, err := s.SendQueue.List(userid, []string{sendqueue.StatusPending, sendqueue.StatusSending}, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) != queued[userid] {
+			t.Errorf("user %d has %d pending messages, want %d", userid, len(items), queued[userid])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"wuzapi/internal/idempotency"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Wraps a handler so requests with an Idempotency-Key header run only once: a retry
+// with the same key and payload gets the first response back. Keys are kept for a
+// day, failed requests (5xx) release their key so they can be retried.
+func (s *Server) Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(idempotency.Header)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Idempotency-Key can not be longer than 255 characters"))
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		record, started, err := idempotency.Begin(s.Db, userid, key, hash)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not check Idempotency-Key: %v", err))
+			return
+		}
+		if !started {
+			if record.Hash != hash {
+				s.Respond(w, r, http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used for a different request"))
+				return
+			}
+			if record.Code == 0 {
+				s.Respond(w, r, http.StatusConflict, errors.New("A request with this Idempotency-Key is in progress"))
+				return
+			}
+			log.Info().Str("userid", txtid).Str("key", key).Msg("Replaying idempotent request")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(idempotency.ReplayedHeader, "true")
+			w.WriteHeader(record.Code)
+			w.Write(record.Response)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		next(rec, r)
+		if rec.Code >= http.StatusInternalServerError {
+			err = idempotency.Release(s.Db, userid, key)
+		} else {
+			err = idempotency.Finish(s.Db, userid, key, rec.Code, rec.Body.Bytes())
+		}
+		if err != nil {
+			log.Error().Err(err).Str("userid", txtid).Str("key", key).Msg("Could not store idempotent response")
+		}
+
+		for name, values := range rec.Header() {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}
+}
@@ -0,0 +1,29 @@
+package controller
+
+import (
+	"strconv"
+	"wuzapi/internal/messages"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Stores a message sent through the API, failing to store it does not fail the send
+func (s *Server) StoreSentMessage(userid int, client *whatsmeow.Client, recipient types.JID, resp whatsmeow.SendResponse, msg *waProto.Message) {
+	sender := types.EmptyJID
+	if client.Store.ID != nil {
+		sender = *client.Store.ID
+	}
+	err := messages.Save(s.Db, messages.FromSent(userid, recipient, sender, resp.ID, resp.Timestamp, msg))
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("id", resp.ID).Msg("Could not store sent message")
+	}
+	if poll := messages.PollOf(msg); poll != nil {
+		err = messages.SavePoll(s.Db, userid, recipient.String(), resp.ID, poll)
+		if err != nil {
+			log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("id", resp.ID).Msg("Could not store sent poll")
+		}
+	}
+}
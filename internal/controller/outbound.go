@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+	"wuzapi/internal/outbound"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Starts consuming the broker queue of a user if it has one, until ctx is done
+func (s *Server) StartConsumer(ctx context.Context, userid int) {
+	err := s.Consumers.Start(ctx, userid, s.SendFromBroker(userid))
+	if err != nil {
+		log.Error().Err(err).Int("userid", userid).Msg("Could not start send consumer")
+	}
+}
+
+// Builds the handler sending messages consumed from a broker. A message holds the
+// payload of a /chat/send endpoint plus its Type (text, image, location...) and an
+// optional Reference echoed in the result.
+func (s *Server) SendFromBroker(userid int) outbound.Handler {
+	txtid := strconv.Itoa(userid)
+
+	return func(ctx context.Context, body []byte) ([]byte, bool) {
+		var t struct {
+			Type      string
+			Reference string
+		}
+		result := map[string]interface{}{"type": "SendResult", "userId": userid}
+		finish := func(code int, id string, err string) ([]byte, bool) {
+			result["reference"] = t.Reference
+			result["sendType"] = t.Type
+			result["code"] = code
+			result["success"] = err == ""
+			result["id"] = id
+			result["error"] = err
+			result["timestamp"] = time.Now().Unix()
+			data, _ := json.Marshal(result)
+			return data, true
+		}
+
+		err := json.Unmarshal(body, &t)
+		if err != nil {
+			return finish(http.StatusBadRequest, "", "Could not decode Payload")
+		}
+		handler, ok := s.SendHandlers[t.Type]
+		if !ok {
+			return finish(http.StatusBadRequest, "", "Invalid Type: "+t.Type)
+		}
+
+		// Wait for the session to be ready instead of failing the message
+		for {
+			client := s.Sessions.Client(userid)
+			if client != nil && client.IsConnected() && client.IsLoggedIn() {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, false
+			case <-time.After(time.Second):
+			}
+		}
+
+		// Wait for the send queue so the result tells whether the message went out
+		code, response, err := s.RunSendHandler(ctx, userid, handler, t.Type, "wait=true", body)
+		if err != nil {
+			return finish(code, "", err.Error())
+		}
+		log.Info().Str("userid", txtid).Str("type", t.Type).Int("code", code).Str("id", response.Data.Id).Msg("Sent message from broker")
+		return finish(code, response.Data.Id, response.Error)
+	}
+}
+
+// Response of a /chat/send handler
+type SendResponse struct {
+	Data struct {
+		Id      string
+		QueueId int64
+	}
+	Error string
+}
+
+// Runs a /chat/send handler for a user outside of an HTTP request, so payloads
+// behave exactly the same as through the endpoint
+func (s *Server) RunSendHandler(ctx context.Context, userid int, handler http.HandlerFunc, msgType string, query string, body []byte) (int, *SendResponse, error) {
+	txtid := strconv.Itoa(userid)
+	userinfo, err := s.LoadUserInfo(txtid)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	tokeninfo := internalTypes.Values{M: map[string]string{"Id": txtid, "Scopes": internalTypes.ScopeSend}}
+
+	target := "/chat/send/" + msgType
+	if query != "" {
+		target += "?" + query
+	}
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r = r.WithContext(context.WithValue(context.WithValue(ctx, "userinfo", userinfo), "tokeninfo", tokeninfo))
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	response := SendResponse{}
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		return w.Code, nil, errors.New("Could not decode send response")
+	}
+	return w.Code, &response, nil
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"wuzapi/internal/scheduler"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Wraps a /chat/send handler so payloads with a SendAt time or a Cron expression
+// are stored and sent later instead of right away
+func (s *Server) Schedulable(msgType string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not read Payload"))
+			return
+		}
+
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) != nil || (fields["SendAt"] == nil && fields["Cron"] == nil) {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next(w, r)
+			return
+		}
+
+		txtid := r.Context().Value("userinfo").(internalTypes.Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		m := scheduler.Message{UserId: userid, Type: msgType}
+		if fields["SendAt"] != nil && fields["Cron"] != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Use either SendAt or Cron"))
+			return
+		}
+		if fields["SendAt"] != nil {
+			sendAt, err := parseSendAt(fields["SendAt"])
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			if sendAt.Before(time.Now()) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("SendAt must be in the future"))
+				return
+			}
+			m.SendAt = sendAt.Unix()
+		} else {
+			// Every run sends a new message, a message Id can only be used once
+			if fields["Id"] != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Id can not be used with Cron"))
+				return
+			}
+			err = json.Unmarshal(fields["Cron"], &m.Cron)
+			if err == nil {
+				_, err = scheduler.Next(m.Cron, time.Now())
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, fmt.Errorf("Invalid Cron: %v", err))
+				return
+			}
+		}
+		if fields["Phone"] == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		delete(fields, "SendAt")
+		delete(fields, "Cron")
+		payload, err := json.Marshal(fields)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		m.Payload = string(payload)
+
+		err = s.Scheduler.Add(&m)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not schedule message: %v", err))
+			return
+		}
+
+		log.Info().Str("userid", txtid).Int64("scheduleid", m.Id).Str("type", msgType).Int64("send_at", m.SendAt).Str("cron", m.Cron).Msg("Message scheduled")
+		response := map[string]interface{}{"Details": "Scheduled", "ScheduleId": m.Id, "SendAt": time.Unix(m.SendAt, 0)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusAccepted, string(responseJson))
+		}
+	}
+}
+
+// SendAt is either unix seconds or an RFC 3339 time
+func parseSendAt(raw json.RawMessage) (time.Time, error) {
+	var unix int64
+	if json.Unmarshal(raw, &unix) == nil {
+		return time.Unix(unix, 0), nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		t, err := time.Parse(time.RFC3339, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("SendAt must be unix seconds or an RFC 3339 time")
+}
+
+// Hands a due scheduled message to its /chat/send handler, which queues it
+func (s *Server) FireScheduled(m *scheduler.Message) (int64, error) {
+	if s.Sessions.Client(m.UserId) == nil {
+		return 0, scheduler.ErrNotReady
+	}
+	handler, ok := s.SendHandlers[m.Type]
+	if !ok {
+		return 0, errors.New("Invalid Type: " + m.Type)
+	}
+
+	_, response, err := s.RunSendHandler(context.Background(), m.UserId, handler, m.Type, "", []byte(m.Payload))
+	if err != nil {
+		return 0, err
+	}
+	if response.Error != "" {
+		return 0, errors.New(response.Error)
+	}
+	log.Info().Int("userid", m.UserId).Int64("scheduleid", m.Id).Int64("queueid", response.Data.QueueId).Msg("Scheduled message queued")
+	return response.Data.QueueId, nil
+}
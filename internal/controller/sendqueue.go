@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"wuzapi/internal/messages"
+	"wuzapi/internal/sendqueue"
+
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Starts sending the queued messages of a user until ctx is done
+func (s *Server) StartSendQueue(ctx context.Context, userid int) {
+	go s.SendQueue.Run(ctx, userid, func(ctx context.Context, recipient types.JID, msgid string, msg *waProto.Message) (time.Time, error) {
+		client := s.Sessions.Client(userid)
+		if client == nil || !client.IsConnected() || !client.IsLoggedIn() {
+			return time.Time{}, sendqueue.ErrNotReady
+		}
+		resp, err := client.SendMessage(ctx, recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			return time.Time{}, err
+		}
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", resp.ID).Msg("Message sent")
+		s.StoreSentMessage(userid, client, recipient, resp, msg)
+		return resp.Timestamp, nil
+	})
+}
+
+// Message ids clients can choose, like the ones Whatsapp generates
+var validMessageId = regexp.MustCompile(`^[0-9A-Za-z]{8,64}$`)
+
+// Queues a message built by a /chat/send handler and responds with its queue id. With
+// wait=true in the query string, responds once the message is sent instead. The message
+// is sent with msgid as its Whatsapp id, which can only be used once.
+func (s *Server) QueueMessage(w http.ResponseWriter, r *http.Request, userid int, recipient types.JID, msgid string, msgType string, msg *waProto.Message) {
+	// Ids Whatsapp would not take, like UUIDs, are still accepted as they were before ids were
+	// honored: the response echoes them and the message goes out with a generated id
+	clientid := msgid
+	if !validMessageId.MatchString(msgid) {
+		msgid = whatsmeow.GenerateMessageID()
+	}
+	queued, err := s.SendQueue.FindMessage(userid, msgid)
+	if err == nil && queued == nil {
+		var stored *messages.Message
+		stored, _, err = messages.Get(s.Db, userid, msgid)
+		if stored != nil {
+			s.Respond(w, r, http.StatusConflict, errors.New("Id was already used by message "+msgid))
+			return
+		}
+	}
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not check Id: %v", err))
+		return
+	}
+	if queued != nil && queued.Status != sendqueue.StatusFailed {
+		s.Respond(w, r, http.StatusConflict, fmt.Errorf("Id was already used by queued message %d", queued.Id))
+		return
+	}
+
+	// The checks above can race with another request using the same Id, the queue rejects the second one
+	id, err := s.SendQueue.Enqueue(userid, recipient, msgid, msgType, msg)
+	if errors.Is(err, sendqueue.ErrDuplicate) {
+		s.Respond(w, r, http.StatusConflict, errors.New("Id was already used by a queued message"))
+		return
+	}
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, fmt.Errorf("Could not queue message: %v", err))
+		return
+	}
+	log.Info().Str("userid", strconv.Itoa(userid)).Int64("queueid", id).Str("id", msgid).Msg("Message queued")
+
+	response := map[string]interface{}{"Details": "Queued", "QueueId": id, "Id": clientid}
+	if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait")); wait {
+		item, err := s.SendQueue.Wait(r.Context(), userid, id)
+		if err == nil && item != nil {
+			switch item.Status {
+			case sendqueue.StatusSent:
+				response = map[string]interface{}{"Details": "Sent", "Timestamp": time.Unix(item.Sent, 0), "Id": clientid, "QueueId": id}
+			case sendqueue.StatusFailed:
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Error sending message: "+item.Error))
+				return
+			case sendqueue.StatusCancelled:
+				s.Respond(w, r, http.StatusConflict, errors.New("Message cancelled"))
+				return
+			}
+		}
+	}
+
+	if clientid != msgid {
+		response["MessageId"] = msgid
+	}
+
+	status := http.StatusAccepted
+	if response["Details"] == "Sent" {
+		status = http.StatusOK
+	}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
+	} else {
+		s.Respond(w, r, status, string(responseJson))
+	}
+}
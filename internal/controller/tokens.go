@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"wuzapi/internal/helpers"
+	internalTypes "wuzapi/internal/types"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog/log"
+)
+
+var errUnauthorized = errors.New("Unauthorized")
+var errTokenExpired = errors.New("Token expired")
+
+type Token struct {
+	Id      int
+	UserId  int
+	Name    string
+	Scopes  []string
+	Created int64
+}
+
+// Creates a named token for a user, only its salted hash is stored
+func (s *Server) CreateToken(userid int, name string, token string, scopes []string) (int64, error) {
+	return insertToken(s.Db, userid, name, token, scopes)
+}
+
+// Creates a named token for a user as part of a transaction
+func (s *Server) CreateTokenTx(tx *sql.Tx, userid int, name string, token string, scopes []string) (int64, error) {
+	return insertToken(tx, userid, name, token, scopes)
+}
+
+func insertToken(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, userid int, name string, token string, scopes []string) (int64, error) {
+	salt, err := helpers.GenerateToken()
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("INSERT INTO tokens (user_id,name,prefix,salt,hash,scopes,created) VALUES (?,?,?,?,?,?,?)", userid, name, helpers.TokenPrefix(token), salt, helpers.HashToken(salt, token), strings.Join(scopes, ","), time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Finds the stored token matching a plaintext token, returns nil if there is none
+func (s *Server) FindToken(token string) (*Token, error) {
+	if token == "" {
+		return nil, nil
+	}
+	rows, err := s.Db.Query("SELECT id,user_id,name,salt,hash,scopes,created FROM tokens WHERE prefix=?", helpers.TokenPrefix(token))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := Token{}
+		salt := ""
+		hash := ""
+		scopes := ""
+		err = rows.Scan(&t.Id, &t.UserId, &t.Name, &salt, &hash, &scopes, &t.Created)
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(helpers.HashToken(salt, token)), []byte(hash)) == 1 {
+			t.Scopes = strings.Split(scopes, ",")
+			return &t, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// Moves plaintext tokens left in the users table to hashed tokens with all scopes
+func (s *Server) MigrateLegacyTokens() error {
+	rows, err := s.Db.Query("SELECT id,token FROM users WHERE token!=''")
+	if err != nil {
+		return err
+	}
+	legacy := make(map[int]string)
+	for rows.Next() {
+		userid := 0
+		token := ""
+		err = rows.Scan(&userid, &token)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		legacy[userid] = token
+	}
+	rows.Close()
+
+	for userid, token := range legacy {
+		_, err = s.CreateToken(userid, "default", token, []string{internalTypes.ScopeAll})
+		if err != nil {
+			return err
+		}
+		_, err = s.Db.Exec("UPDATE users SET token='' WHERE id=?", userid)
+		if err != nil {
+			return err
+		}
+		log.Info().Str("userid", strconv.Itoa(userid)).Msg("Migrated plaintext token")
+	}
+	return nil
+}
+
+// Drops cached authentication for a token, or for all tokens of a user if tokenid is 0
+func (s *Server) ForgetTokens(userid int, tokenid int) {
+	for key, item := range s.UserInfoCache.Items() {
+		if !strings.HasPrefix(key, "token:") {
+			continue
+		}
+		v := item.Object.(internalTypes.Values)
+		if v.Get("Id") != strconv.Itoa(userid) {
+			continue
+		}
+		if tokenid == 0 || v.Get("TokenId") == strconv.Itoa(tokenid) {
+			s.UserInfoCache.Delete(key)
+		}
+	}
+}
+
+// Checks if a comma separated scope list grants scope
+func HasScope(scopes string, scope string) bool {
+	for _, item := range strings.Split(scopes, ",") {
+		if item == scope || item == internalTypes.ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+// Looks up user and token information for the token in a request
+func (s *Server) authenticate(r *http.Request) (internalTypes.Values, internalTypes.Values, int, error) {
+
+	// Get token from headers or uri parameters
+	token := r.Header.Get("token")
+	if token == "" {
+		token = strings.Join(r.URL.Query()["token"], "")
+	}
+	if token == "" {
+		return internalTypes.Values{}, internalTypes.Values{}, http.StatusUnauthorized, errUnauthorized
+	}
+
+	// Tokens are cached by their unsalted hash so plaintext tokens are never kept in memory
+	tokenkey := "token:" + helpers.HashToken("", token)
+	var tokeninfo internalTypes.Values
+	cached, found := s.UserInfoCache.Get(tokenkey)
+	if found {
+		tokeninfo = cached.(internalTypes.Values)
+	} else {
+		log.Info().Msg("Looking for token information in DB")
+		t, err := s.FindToken(token)
+		if err != nil {
+			return internalTypes.Values{}, internalTypes.Values{}, http.StatusInternalServerError, err
+		}
+		if t == nil {
+			return internalTypes.Values{}, internalTypes.Values{}, http.StatusUnauthorized, errUnauthorized
+		}
+		tokeninfo = internalTypes.Values{M: map[string]string{
+			"Id":      strconv.Itoa(t.UserId),
+			"TokenId": strconv.Itoa(t.Id),
+			"Name":    t.Name,
+			"Scopes":  strings.Join(t.Scopes, ","),
+		}}
+		s.UserInfoCache.Set(tokenkey, tokeninfo, cache.DefaultExpiration)
+	}
+
+	txtid := tokeninfo.Get("Id")
+	var userinfo internalTypes.Values
+	cached, found = s.UserInfoCache.Get(txtid)
+	if found {
+		userinfo = cached.(internalTypes.Values)
+	} else {
+		log.Info().Msg("Looking for user information in DB")
+		var err error
+		userinfo, err = s.LoadUserInfo(txtid)
+		if err == sql.ErrNoRows {
+			userid, _ := strconv.Atoi(txtid)
+			s.ForgetTokens(userid, 0)
+			return internalTypes.Values{}, internalTypes.Values{}, http.StatusUnauthorized, errUnauthorized
+		} else if err != nil {
+			return internalTypes.Values{}, internalTypes.Values{}, http.StatusInternalServerError, err
+		}
+	}
+
+	if helpers.IsExpired(userinfo.Get("Expiration")) {
+		return internalTypes.Values{}, internalTypes.Values{}, http.StatusUnauthorized, errTokenExpired
+	}
+	return userinfo, tokeninfo, http.StatusOK, nil
+}
+
+// Loads user information from DB into the user info cache
+func (s *Server) LoadUserInfo(txtid string) (internalTypes.Values, error) {
+	webhook := ""
+	jid := ""
+	events := ""
+	var expiration sql.NullInt64
+	err := s.Db.QueryRow("SELECT webhook,jid,events,expiration FROM users WHERE id=? LIMIT 1", txtid).Scan(&webhook, &jid, &events, &expiration)
+	if err != nil {
+		return internalTypes.Values{}, err
+	}
+	v := internalTypes.Values{M: map[string]string{
+		"Id":         txtid,
+		"Jid":        jid,
+		"Webhook":    webhook,
+		"Events":     events,
+		"Expiration": strconv.FormatInt(expiration.Int64, 10),
+	}}
+	s.UserInfoCache.Set(txtid, v, cache.NoExpiration)
+	return v, nil
+}
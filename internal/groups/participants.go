@@ -0,0 +1,84 @@
+package groups
+
+import (
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Outcomes of adding, removing, promoting or demoting a participant
+const (
+	StatusOK = "ok"
+	// The participant only accepts being added through an invite, use InviteCode to send one
+	StatusInviteRequired = "invite_required"
+	StatusNotFound       = "not_found"
+	StatusAlreadyMember  = "already_member"
+	// The participant left the group recently and can not be added back yet
+	StatusRecentlyLeft = "recently_left"
+	StatusError        = "error"
+)
+
+// How a change went for one participant
+type ParticipantResult struct {
+	Jid    string
+	Status string
+	// Whatsapp error code, 0 when the change succeeded
+	Error            int
+	InviteCode       string
+	InviteExpiration int64
+}
+
+// Names a Whatsapp participant error code
+func status(code int) string {
+	switch code {
+	case 0, 200:
+		return StatusOK
+	case 403:
+		return StatusInviteRequired
+	case 404:
+		return StatusNotFound
+	case 408:
+		return StatusRecentlyLeft
+	case 409:
+		return StatusAlreadyMember
+	}
+	return StatusError
+}
+
+// Gets the results of adding participants when creating a group
+func FromParticipants(participants []types.GroupParticipant) []ParticipantResult {
+	results := []ParticipantResult{}
+	for _, p := range participants {
+		result := ParticipantResult{Jid: p.JID.String(), Status: status(p.Error), Error: p.Error}
+		if p.AddRequest != nil {
+			result.InviteCode = p.AddRequest.Code
+			if !p.AddRequest.Expiration.IsZero() {
+				result.InviteExpiration = p.AddRequest.Expiration.Unix()
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Gets the per participant results from the response to a participants update,
+// which holds a node per action with a participant node per changed member
+func FromUpdate(resp *waBinary.Node) []ParticipantResult {
+	results := []ParticipantResult{}
+	if resp == nil {
+		return results
+	}
+	for _, action := range resp.GetChildren() {
+		for _, child := range action.GetChildrenByTag("participant") {
+			ag := child.AttrGetter()
+			code := ag.OptionalInt("error")
+			result := ParticipantResult{Jid: ag.OptionalJIDOrEmpty("jid").String(), Status: status(code), Error: code}
+			if request, ok := child.GetOptionalChildByTag("add_request"); ok {
+				requestAG := request.AttrGetter()
+				result.InviteCode = requestAG.OptionalString("code")
+				result.InviteExpiration, _ = requestAG.GetInt64("expiration", false)
+			}
+			results = append(results, result)
+		}
+	}
+	return results
+}
@@ -0,0 +1,136 @@
+package groups
+
+import (
+	"go.mau.fi/whatsmeow"
+	waBinary "go.mau.fi/whatsmeow/binary"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Membership approval is not wrapped by whatsmeow yet, these send the same group
+// queries Whatsapp Web uses
+
+// Someone waiting for an admin to approve them joining a group
+type JoinRequest struct {
+	Jid         string
+	RequestedAt int64
+}
+
+// Actions on join requests
+const (
+	RequestApprove = "approve"
+	RequestReject  = "reject"
+)
+
+// Sends a query about a group, like whatsmeow does for its own group calls
+func groupIQ(client *whatsmeow.Client, iqType string, group types.JID, content waBinary.Node) (*waBinary.Node, error) {
+	return client.DangerousInternals().SendIQ(whatsmeow.DangerousInfoQuery{
+		Namespace: "w:g2",
+		Type:      whatsmeow.DangerousInfoQueryType(iqType),
+		To:        group,
+		Content:   []waBinary.Node{content},
+	})
+}
+
+// Lists the pending join requests of a group
+func GetJoinRequests(client *whatsmeow.Client, group types.JID) ([]JoinRequest, error) {
+	resp, err := groupIQ(client, "get", group, waBinary.Node{Tag: "membership_approval_requests"})
+	if err != nil {
+		return nil, err
+	}
+	requests := []JoinRequest{}
+	list, ok := resp.GetOptionalChildByTag("membership_approval_requests")
+	if !ok {
+		return requests, nil
+	}
+	for _, child := range list.GetChildrenByTag("membership_approval_request") {
+		ag := child.AttrGetter()
+		request := JoinRequest{Jid: ag.OptionalJIDOrEmpty("jid").String()}
+		request.RequestedAt, _ = ag.GetInt64("request_time", false)
+		requests = append(requests, request)
+	}
+	return requests, nil
+}
+
+// Approves or rejects join requests, returns the result for each participant
+func UpdateJoinRequests(client *whatsmeow.Client, group types.JID, participants []types.JID, action string) ([]ParticipantResult, error) {
+	content := make([]waBinary.Node, len(participants))
+	for i, participant := range participants {
+		content[i] = waBinary.Node{Tag: "participant", Attrs: waBinary.Attrs{"jid": participant}}
+	}
+	resp, err := groupIQ(client, "set", group, waBinary.Node{
+		Tag:     "membership_requests_action",
+		Content: []waBinary.Node{{Tag: action, Content: content}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	results := []ParticipantResult{}
+	node, ok := resp.GetOptionalChildByTag("membership_requests_action", action)
+	if !ok {
+		return results, nil
+	}
+	for _, child := range node.GetChildrenByTag("participant") {
+		ag := child.AttrGetter()
+		code := ag.OptionalInt("error")
+		results = append(results, ParticipantResult{Jid: ag.OptionalJIDOrEmpty("jid").String(), Status: status(code), Error: code})
+	}
+	return results, nil
+}
+
+// Turns membership approval on or off, when on admins have to approve whoever joins
+func SetJoinApproval(client *whatsmeow.Client, group types.JID, approval bool) error {
+	state := "off"
+	if approval {
+		state = "on"
+	}
+	_, err := groupIQ(client, "set", group, waBinary.Node{
+		Tag:     "membership_approval_mode",
+		Content: []waBinary.Node{{Tag: "group_join", Attrs: waBinary.Attrs{"state": state}}},
+	})
+	return err
+}
+
+// Join request changes found among the group changes whatsmeow does not know
+type JoinRequestChange struct {
+	// created when someone asked to join, revoked when the request was withdrawn or rejected
+	Action string
+	Jids   []string
+	// How the request was made: invite_link, linked_group_join or non_admin_add
+	Method string
+}
+
+// Gets the join request changes and approval mode change in a group notification
+func FromUnknownChanges(nodes []*waBinary.Node, sender *types.JID) ([]JoinRequestChange, *bool) {
+	changes := []JoinRequestChange{}
+	var approval *bool
+	for _, node := range nodes {
+		ag := node.AttrGetter()
+		action := ""
+		switch node.Tag {
+		case "created_membership_requests", "membership_approval_request":
+			action = "created"
+		case "revoked_membership_requests":
+			action = "revoked"
+		case "membership_approval_mode":
+			if join, ok := node.GetOptionalChildByTag("group_join"); ok {
+				on := join.AttrGetter().OptionalString("state") == "on"
+				approval = &on
+			}
+			continue
+		default:
+			continue
+		}
+		change := JoinRequestChange{Action: action, Method: ag.OptionalString("request_method")}
+		for _, child := range node.GetChildren() {
+			if jid := child.AttrGetter().OptionalJID("jid"); jid != nil {
+				change.Jids = append(change.Jids, jid.ToNonAD().String())
+			}
+		}
+		// The requester is the sender of the notification when it is not listed
+		if len(change.Jids) == 0 && sender != nil {
+			change.Jids = append(change.Jids, sender.ToNonAD().String())
+		}
+		changes = append(changes, change)
+	}
+	return changes, approval
+}
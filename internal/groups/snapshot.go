@@ -0,0 +1,114 @@
+package groups
+
+import (
+	"database/sql"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Last known settings of a group, kept to tell the old values of a change
+type Snapshot struct {
+	Name     string
+	Topic    string
+	Locked   bool
+	Announce bool
+	// Disappearing messages timer in seconds, 0 when off
+	Ephemeral uint32
+}
+
+// A setting changed in a group, Old is nil when the previous value is not known
+type Change struct {
+	Old interface{}
+	New interface{}
+}
+
+// Takes the settings of a group from its info
+func SnapshotOf(info *types.GroupInfo) Snapshot {
+	return Snapshot{
+		Name:      info.Name,
+		Topic:     info.Topic,
+		Locked:    info.IsLocked,
+		Announce:  info.IsAnnounce,
+		Ephemeral: info.DisappearingTimer,
+	}
+}
+
+// Gets the last known settings of a group, returns nil if there are none
+func GetSnapshot(db *sql.DB, userid int, group string) (*Snapshot, error) {
+	s := Snapshot{}
+	err := db.QueryRow("SELECT name,topic,locked,announce,ephemeral FROM group_snapshots WHERE user_id=? AND group_jid=?", userid, group).Scan(&s.Name, &s.Topic, &s.Locked, &s.Announce, &s.Ephemeral)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Stores the settings of a group, replacing the ones known before
+func SaveSnapshot(db *sql.DB, userid int, group string, s Snapshot) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO group_snapshots (user_id,group_jid,name,topic,locked,announce,ephemeral,updated) VALUES (?,?,?,?,?,?,?,?)", userid, group, s.Name, s.Topic, s.Locked, s.Announce, s.Ephemeral, time.Now().Unix())
+	return err
+}
+
+// Drops the settings of a group, once it was deleted
+func DeleteSnapshot(db *sql.DB, userid int, group string) error {
+	_, err := db.Exec("DELETE FROM group_snapshots WHERE user_id=? AND group_jid=?", userid, group)
+	return err
+}
+
+// Gets the settings changed by a group info event, by name, with their old values
+// taken from old when it is set. Also returns old with the changes applied.
+func Changes(old *Snapshot, evt *events.GroupInfo) (map[string]Change, Snapshot) {
+	changes := map[string]Change{}
+	current := Snapshot{}
+	if old != nil {
+		current = *old
+	}
+	change := func(name string, previous interface{}, value interface{}) {
+		c := Change{New: value}
+		if old != nil {
+			c.Old = previous
+		}
+		changes[name] = c
+	}
+
+	if evt.Name != nil {
+		change("Name", current.Name, evt.Name.Name)
+		current.Name = evt.Name.Name
+	}
+	if evt.Topic != nil {
+		topic := evt.Topic.Topic
+		if evt.Topic.TopicDeleted {
+			topic = ""
+		}
+		change("Topic", current.Topic, topic)
+		current.Topic = topic
+	}
+	if evt.Locked != nil {
+		change("Locked", current.Locked, evt.Locked.IsLocked)
+		current.Locked = evt.Locked.IsLocked
+	}
+	if evt.Announce != nil {
+		change("Announce", current.Announce, evt.Announce.IsAnnounce)
+		current.Announce = evt.Announce.IsAnnounce
+	}
+	if evt.Ephemeral != nil {
+		timer := evt.Ephemeral.DisappearingTimer
+		if !evt.Ephemeral.IsEphemeral {
+			timer = 0
+		}
+		change("Ephemeral", current.Ephemeral, timer)
+		current.Ephemeral = timer
+	}
+	if evt.Delete != nil {
+		changes["Deleted"] = Change{Old: false, New: evt.Delete.Deleted}
+	}
+	// Invite links are not kept, only the new one is known
+	if evt.NewInviteLink != nil {
+		changes["InviteLink"] = Change{New: *evt.NewInviteLink}
+	}
+	return changes, current
+}
@@ -1,6 +1,11 @@
 package helpers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
 	internalTypes "wuzapi/internal/types"
 
 	"github.com/rs/zerolog/log"
@@ -21,3 +26,41 @@ func UpdateUserInfo(values interface{}, field string, value string) interface{}
 	values.(internalTypes.Values).M[field] = value
 	return values
 }
+
+// Generates a random hex encoded token to be used for API authentication
+func GenerateToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Checks if a unix timestamp expiration has passed, empty or 0 never expires
+func IsExpired(expiration string) bool {
+	ts, _ := strconv.ParseInt(expiration, 10, 64)
+	if ts <= 0 {
+		return false
+	}
+	return time.Now().Unix() >= ts
+}
+
+// Hashes a token with the given salt for storage
+func HashToken(salt string, token string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Shortest token accepted, tokens are looked up by a plaintext prefix which must
+// only be a small part of them
+const MinTokenLength = 16
+
+// Gets the indexed lookup prefix of a token, empty for tokens too short to give
+// away part of them
+func TokenPrefix(token string) string {
+	if len(token) < MinTokenLength {
+		return ""
+	}
+	return token[:8]
+}
@@ -2,7 +2,9 @@ package helpers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"os"
@@ -10,14 +12,19 @@ import (
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
+	"wuzapi/internal/groups"
+	"wuzapi/internal/messages"
+	"wuzapi/internal/sessions"
+	"wuzapi/internal/stream"
 	internalTypes "wuzapi/internal/types"
 	"wuzapi/webhook"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/patrickmn/go-cache"
 	"github.com/rs/zerolog/log"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
 	_ "modernc.org/sqlite"
 
 	//	"go.mau.fi/whatsmeow/store/sqlstore"
@@ -27,18 +34,18 @@ import (
 )
 
 // var wlog waLog.Logger
-var clientPointer = make(map[int]*whatsmeow.Client)
-var clientHttp = make(map[int]*resty.Client)
 var historySyncID int32
 
 type MyClient struct {
 	WAClient       *whatsmeow.Client
 	EventHandlerID uint32
 	UserID         int
-	Token          string
-	Subscriptions  []string
 	UserInfoCache  *cache.Cache
-	KillChannel    map[int](chan bool)
+	Sessions       *sessions.Registry
+	Session        *sessions.Session
+	Outbox         *webhook.Outbox
+	Media          *webhook.MediaSigner
+	Stream         *stream.Hub
 	Db             *sql.DB
 }
 
@@ -88,6 +95,8 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 	postmap["event"] = rawEvt
 	dowebhook := 0
 	path := ""
+	// Chat the event belongs to, used by endpoint chat filters
+	chat := ""
 
 	ex, err := os.Executable()
 	if err != nil {
@@ -106,8 +115,15 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 			}
 		}
 	case *events.Connected, *events.PushNameSetting:
+		if _, ok := evt.(*events.Connected); ok {
+			mycli.Session.SetState(sessions.StateConnected, nil)
+			postmap["type"] = "Connected"
+			dowebhook = 1
+			// Group changes are reported with the values they replace
+			go mycli.snapshotGroups()
+		}
 		if len(mycli.WAClient.Store.PushName) == 0 {
-			return
+			break
 		}
 		// Send presence available when connecting and when the pushname is changed.
 		// This makes sure that outgoing messages always have the right pushname.
@@ -124,7 +140,7 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 			return
 		}
 	case *events.PairSuccess:
-		log.Info().Str("userid", strconv.Itoa(mycli.UserID)).Str("token", mycli.Token).Str("ID", evt.ID.String()).Str("BusinessName", evt.BusinessName).Str("Platform", evt.Platform).Msg("QR Pair Success")
+		log.Info().Str("userid", strconv.Itoa(mycli.UserID)).Str("ID", evt.ID.String()).Str("BusinessName", evt.BusinessName).Str("Platform", evt.Platform).Msg("QR Pair Success")
 		jid := evt.ID
 		sqlStmt := `UPDATE users SET jid=? WHERE id=?`
 		_, err := mycli.Db.Exec(sqlStmt, jid, mycli.UserID)
@@ -133,22 +149,41 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 			return
 		}
 
-		myuserinfo, found := mycli.UserInfoCache.Get(mycli.Token)
+		myuserinfo, found := mycli.UserInfoCache.Get(txtid)
 		if !found {
 			log.Warn().Msg("No user info cached on pairing?")
 		} else {
-			txtid := myuserinfo.(internalTypes.Values).Get("Id")
-			token := myuserinfo.(internalTypes.Values).Get("Token")
 			v := UpdateUserInfo(myuserinfo, "Jid", fmt.Sprintf("%s", jid))
-			mycli.UserInfoCache.Set(token, v, cache.NoExpiration)
-			log.Info().Str("jid", jid.String()).Str("userid", txtid).Str("token", token).Msg("User information set")
+			mycli.UserInfoCache.Set(txtid, v, cache.NoExpiration)
+			log.Info().Str("jid", jid.String()).Str("userid", txtid).Msg("User information set")
 		}
 	case *events.StreamReplaced:
 		log.Info().Msg("Received StreamReplaced event")
+		mycli.Session.SetState(sessions.StateDisconnected, errors.New("Stream replaced by another connection"))
 		return
+	case *events.Disconnected:
+		log.Warn().Str("userid", txtid).Msg("Disconnected from Whatsapp")
+		mycli.Session.SetState(sessions.StateDisconnected, nil)
+		postmap["type"] = "Disconnected"
+		dowebhook = 1
+	case *events.ConnectFailure:
+		log.Warn().Str("userid", txtid).Str("reason", evt.Reason.String()).Msg("Connection failure")
+		mycli.Session.SetState(sessions.StateDisconnected, fmt.Errorf("Connection failure: %s", evt.Reason.String()))
+	case *events.TemporaryBan:
+		log.Error().Str("userid", txtid).Str("ban", evt.String()).Msg("Temporarily banned")
+		mycli.Session.SetState(sessions.StateFailed, fmt.Errorf("Temporarily banned: %s", evt.String()))
+		mycli.Sessions.Kill(mycli.UserID)
+	case *events.ClientOutdated:
+		log.Error().Str("userid", txtid).Msg("Client outdated")
+		mycli.Session.SetState(sessions.StateFailed, errors.New("Client outdated"))
+		mycli.Sessions.Kill(mycli.UserID)
 	case *events.Message:
-		postmap["type"] = "Message"
 		dowebhook = 1
+		chat = evt.Info.Chat.String()
+		if mycli.handleProtocolMessage(postmap, evt) || mycli.handlePollVote(postmap, evt) {
+			break
+		}
+		postmap["type"] = "Message"
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
 			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
@@ -165,6 +200,27 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
+		err := messages.Save(mycli.Db, messages.FromEvent(mycli.UserID, evt))
+		if err != nil {
+			log.Error().Err(err).Str("id", evt.Info.ID).Msg("Could not store received message")
+		}
+		if poll := messages.PollOf(evt.Message); poll != nil {
+			err = messages.SavePoll(mycli.Db, mycli.UserID, chat, evt.Info.ID, poll)
+			if err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Msg("Could not store received poll")
+			}
+		}
+		// Record where downloaded media ended up once the event is handled
+		defer func() {
+			if path == "" {
+				return
+			}
+			err := messages.SetMediaPath(mycli.Db, mycli.UserID, evt.Info.Chat.String(), evt.Info.ID, path)
+			if err != nil {
+				log.Error().Err(err).Str("id", evt.Info.ID).Msg("Could not store media path")
+			}
+		}()
+
 		// try to get Image if any
 		img := evt.Message.GetImageMessage()
 		if img != nil {
@@ -264,8 +320,27 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		chat = evt.Chat.String()
+		// Advance the status of messages we sent
+		if !evt.IsFromMe {
+			status := ""
+			switch evt.Type {
+			case events.ReceiptTypeDelivered:
+				status = messages.StatusDelivered
+			case events.ReceiptTypeRead:
+				status = messages.StatusRead
+			case events.ReceiptTypePlayed:
+				status = messages.StatusPlayed
+			}
+			if status != "" {
+				err := messages.ApplyReceipt(mycli.Db, mycli.UserID, evt.Chat.String(), evt.Sender.ToNonAD().String(), evt.MessageIDs, status, evt.Timestamp.Unix())
+				if err != nil {
+					log.Error().Err(err).Strs("id", evt.MessageIDs).Msg("Could not store receipt")
+				}
+			}
+		}
 		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp)).Msg("Message was read")
+			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp.Unix())).Msg("Message was read")
 			if evt.Type == events.ReceiptTypeRead {
 				postmap["state"] = "Read"
 			} else {
@@ -273,7 +348,7 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 			}
 		} else if evt.Type == events.ReceiptTypeDelivered {
 			postmap["state"] = "Delivered"
-			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp)).Msg("Message delivered")
+			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp.Unix())).Msg("Message delivered")
 		} else {
 			// Discard webhooks for inactive or other delivery types
 			return
@@ -281,12 +356,13 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 	case *events.Presence:
 		postmap["type"] = "Presence"
 		dowebhook = 1
+		chat = evt.From.ToNonAD().String()
 		if evt.Unavailable {
 			postmap["state"] = "offline"
 			if evt.LastSeen.IsZero() {
 				log.Info().Str("from", evt.From.String()).Msg("User is now offline")
 			} else {
-				log.Info().Str("from", evt.From.String()).Str("lastSeen", fmt.Sprintf("%d", evt.LastSeen)).Msg("User is now offline")
+				log.Info().Str("from", evt.From.String()).Str("lastSeen", fmt.Sprintf("%d", evt.LastSeen.Unix())).Msg("User is now offline")
 			}
 		} else {
 			postmap["state"] = "online"
@@ -327,7 +403,10 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 		log.Info().Str("index", fmt.Sprintf("%+v", evt.Index)).Str("actionValue", fmt.Sprintf("%+v", evt.SyncActionValue)).Msg("App state event received")
 	case *events.LoggedOut:
 		log.Info().Str("reason", evt.Reason.String()).Msg("Logged out")
-		mycli.KillChannel[mycli.UserID] <- true
+		mycli.Session.SetState(sessions.StateLoggedOut, fmt.Errorf("Logged out: %s", evt.Reason.String()))
+		mycli.Sessions.Kill(mycli.UserID)
+		postmap["type"] = "LoggedOut"
+		dowebhook = 1
 		sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
 		_, err := mycli.Db.Exec(sqlStmt, mycli.UserID)
 		if err != nil {
@@ -337,7 +416,35 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 	case *events.ChatPresence:
 		postmap["type"] = "ChatPresence"
 		dowebhook = 1
+		chat = evt.MessageSource.Chat.String()
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
+	case *events.JoinedGroup:
+		postmap["type"] = "JoinedGroup"
+		dowebhook = 1
+		chat = evt.JID.String()
+		postmap["group"] = chat
+		postmap["name"] = evt.Name
+		postmap["reason"] = evt.Reason
+		log.Info().Str("group", chat).Str("reason", evt.Reason).Str("type", evt.Type).Msg("Joined group")
+		err := groups.SaveSnapshot(mycli.Db, mycli.UserID, chat, groups.SnapshotOf(&evt.GroupInfo))
+		if err != nil {
+			log.Error().Err(err).Str("group", chat).Msg("Could not store group snapshot")
+		}
+	case *events.GroupInfo:
+		mycli.handleGroupInfo(evt)
+	case *events.Picture:
+		if evt.JID.Server != types.GroupServer {
+			log.Info().Str("jid", evt.JID.String()).Msg("Picture changed")
+			break
+		}
+		postmap["type"] = "GroupInfoChanged"
+		dowebhook = 1
+		chat = evt.JID.String()
+		postmap["group"] = chat
+		postmap["actor"] = evt.Author.ToNonAD().String()
+		postmap["timestamp"] = evt.Timestamp.Unix()
+		postmap["changes"] = map[string]groups.Change{"Photo": {New: evt.PictureID}}
+		log.Info().Str("group", chat).Str("actor", evt.Author.String()).Bool("removed", evt.Remove).Msg("Group photo changed")
 	case *events.CallOffer:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer")
 	case *events.CallAccept:
@@ -353,36 +460,351 @@ func (mycli *MyClient) MyEventHandler(rawEvt interface{}) {
 	}
 
 	if dowebhook == 1 {
-		// call webhook
-		webhookurl := ""
-		myuserinfo, found := mycli.UserInfoCache.Get(mycli.Token)
-		if !found {
-			log.Warn().Str("token", mycli.Token).Msg("Could not call webhook as there is no user for this token")
-		} else {
-			webhookurl = myuserinfo.(internalTypes.Values).Get("Webhook")
+		mycli.publishEvent(postmap, path)
+		mycli.dispatchWebhooks(postmap, chat, path)
+	}
+}
+
+// Turns revokes and edits of earlier messages into MessageRevoked and MessageEdited
+// events and applies them to the stored message. Returns false for other messages.
+func (mycli *MyClient) handleProtocolMessage(postmap map[string]interface{}, evt *events.Message) bool {
+	protocol := evt.Message.GetProtocolMessage()
+	if protocol == nil {
+		return false
+	}
+	id := protocol.GetKey().GetId()
+	chat := evt.Info.Chat.String()
+	postmap["messageId"] = id
+
+	switch protocol.GetType() {
+	case waProto.ProtocolMessage_REVOKE:
+		postmap["type"] = "MessageRevoked"
+		log.Info().Str("id", id).Str("source", evt.Info.SourceString()).Msg("Message revoked")
+		err := messages.SetRevoked(mycli.Db, mycli.UserID, chat, id, evt.Info.Timestamp.Unix())
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Could not store message revoke")
+		}
+	case waProto.ProtocolMessage_MESSAGE_EDIT:
+		text := messages.TextOf(protocol.GetEditedMessage())
+		postmap["type"] = "MessageEdited"
+		postmap["text"] = text
+		log.Info().Str("id", id).Str("source", evt.Info.SourceString()).Msg("Message edited")
+		err := messages.SetEdited(mycli.Db, mycli.UserID, chat, id, text, evt.Info.Timestamp.Unix())
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Could not store message edit")
 		}
+	default:
+		delete(postmap, "messageId")
+		return false
+	}
+	return true
+}
 
-		if !Find(mycli.Subscriptions, postmap["type"].(string)) && !Find(mycli.Subscriptions, "All") {
-			log.Warn().Str("type", postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
-			return
+// Turns poll votes into PollVote events naming the selected options. Votes are
+// encrypted with the secret of the poll, which whatsmeow keeps when the poll is
+// sent or received. Returns false for other messages.
+func (mycli *MyClient) handlePollVote(postmap map[string]interface{}, evt *events.Message) bool {
+	update := evt.Message.GetPollUpdateMessage()
+	if update == nil {
+		return false
+	}
+	id := update.GetPollCreationMessageKey().GetId()
+	postmap["type"] = "PollVote"
+	postmap["pollId"] = id
+	postmap["voter"] = evt.Info.Sender.ToNonAD().String()
+
+	vote, err := mycli.WAClient.DecryptPollVote(evt)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Str("source", evt.Info.SourceString()).Msg("Could not decrypt poll vote")
+		postmap["error"] = err.Error()
+		postmap["selectedOptions"] = []string{}
+		return true
+	}
+	poll, err := messages.GetPoll(mycli.Db, mycli.UserID, id)
+	if err != nil {
+		log.Error().Err(err).Str("id", id).Msg("Could not get poll")
+	}
+	if poll == nil {
+		poll = &messages.Poll{MessageId: id}
+	}
+	postmap["pollName"] = poll.Name
+	// An empty selection means the voter removed their vote
+	postmap["selectedOptions"] = poll.OptionNames(vote.GetSelectedOptions())
+	log.Info().Str("id", id).Str("source", evt.Info.SourceString()).Int("selected", len(vote.GetSelectedOptions())).Msg("Poll vote received")
+	return true
+}
+
+// Turns a group change into a GroupParticipantsChanged event per action and a
+// GroupInfoChanged event with the settings changed, with old values when known
+func (mycli *MyClient) handleGroupInfo(evt *events.GroupInfo) {
+	group := evt.JID.String()
+	actor := ""
+	if evt.Sender != nil {
+		actor = evt.Sender.ToNonAD().String()
+	}
+
+	// Joins and leaves by someone else are adds and removals
+	actions := []string{"join", "add", "leave", "remove", "promote", "demote"}
+	participants := map[string][]string{}
+	for _, jid := range evt.Join {
+		action := "add"
+		if evt.Sender == nil || jid.User == evt.Sender.User {
+			action = "join"
+		}
+		participants[action] = append(participants[action], jid.ToNonAD().String())
+	}
+	for _, jid := range evt.Leave {
+		action := "remove"
+		if evt.Sender == nil || jid.User == evt.Sender.User {
+			action = "leave"
+		}
+		participants[action] = append(participants[action], jid.ToNonAD().String())
+	}
+	for _, jid := range evt.Promote {
+		participants["promote"] = append(participants["promote"], jid.ToNonAD().String())
+	}
+	for _, jid := range evt.Demote {
+		participants["demote"] = append(participants["demote"], jid.ToNonAD().String())
+	}
+	for _, action := range actions {
+		if len(participants[action]) == 0 {
+			continue
+		}
+		postmap := map[string]interface{}{"type": "GroupParticipantsChanged", "event": evt, "group": group, "actor": actor, "action": action, "participants": participants[action], "timestamp": evt.Timestamp.Unix()}
+		if action == "join" || action == "add" {
+			postmap["reason"] = evt.JoinReason
 		}
+		log.Info().Str("group", group).Str("actor", actor).Str("action", action).Strs("participants", participants[action]).Msg("Group participants changed")
+		mycli.emit(postmap, group)
+	}
 
-		if webhookurl != "" {
-			log.Info().Str("url", webhookurl).Msg("Calling webhook")
-			values, _ := json.Marshal(postmap)
+	// Join requests and the approval mode are not parsed by whatsmeow
+	requests, approval := groups.FromUnknownChanges(evt.UnknownChanges, evt.Sender)
+	for _, request := range requests {
+		postmap := map[string]interface{}{"type": "GroupJoinRequest", "event": evt, "group": group, "action": request.Action, "requesters": request.Jids, "method": request.Method, "timestamp": evt.Timestamp.Unix()}
+		log.Info().Str("group", group).Str("action", request.Action).Strs("requesters", request.Jids).Msg("Group join request")
+		mycli.emit(postmap, group)
+	}
 
-			webhook := webhook.Webhook{ClientHttp: clientHttp}
-			if path == "" {
-				data := make(map[string]string)
-				data["jsonData"] = string(values)
-				go webhook.CallHook(webhookurl, data, mycli.UserID)
-			} else {
-				data := make(map[string]string)
-				data["jsonData"] = string(values)
-				go webhook.CallHookFile(webhookurl, data, mycli.UserID, path)
+	old, err := groups.GetSnapshot(mycli.Db, mycli.UserID, group)
+	if err != nil {
+		log.Error().Err(err).Str("group", group).Msg("Could not get group snapshot")
+	}
+	changes, current := groups.Changes(old, evt)
+	if approval != nil {
+		changes["JoinApproval"] = groups.Change{New: *approval}
+	}
+	if len(changes) > 0 {
+		postmap := map[string]interface{}{"type": "GroupInfoChanged", "event": evt, "group": group, "actor": actor, "changes": changes, "timestamp": evt.Timestamp.Unix()}
+		log.Info().Str("group", group).Str("actor", actor).Int("changes", len(changes)).Msg("Group info changed")
+		mycli.emit(postmap, group)
+	}
+
+	switch {
+	case evt.Delete != nil:
+		err = groups.DeleteSnapshot(mycli.Db, mycli.UserID, group)
+		if err != nil {
+			log.Error().Err(err).Str("group", group).Msg("Could not delete group snapshot")
+		}
+	case old == nil:
+		// Only part of the settings are in the change, if any, the rest has to be fetched
+		go mycli.snapshotGroup(evt.JID)
+	case len(changes) > 0:
+		err = groups.SaveSnapshot(mycli.Db, mycli.UserID, group, current)
+		if err != nil {
+			log.Error().Err(err).Str("group", group).Msg("Could not store group snapshot")
+		}
+	}
+}
+
+// Stores the settings of every group the user is in
+func (mycli *MyClient) snapshotGroups() {
+	list, err := mycli.WAClient.GetJoinedGroups()
+	if err != nil {
+		log.Warn().Err(err).Str("userid", strconv.Itoa(mycli.UserID)).Msg("Could not get groups to snapshot")
+		return
+	}
+	for _, info := range list {
+		err = groups.SaveSnapshot(mycli.Db, mycli.UserID, info.JID.String(), groups.SnapshotOf(info))
+		if err != nil {
+			log.Error().Err(err).Str("group", info.JID.String()).Msg("Could not store group snapshot")
+		}
+	}
+}
+
+// Stores the settings of a group
+func (mycli *MyClient) snapshotGroup(jid types.JID) {
+	info, err := mycli.WAClient.GetGroupInfo(jid)
+	if err != nil {
+		log.Warn().Err(err).Str("group", jid.String()).Msg("Could not get group to snapshot")
+		return
+	}
+	err = groups.SaveSnapshot(mycli.Db, mycli.UserID, jid.String(), groups.SnapshotOf(info))
+	if err != nil {
+		log.Error().Err(err).Str("group", jid.String()).Msg("Could not store group snapshot")
+	}
+}
+
+// Sends an event built apart from the main switch, for handlers emitting several events
+func (mycli *MyClient) emit(postmap map[string]interface{}, chat string) {
+	mycli.publishEvent(postmap, "")
+	mycli.dispatchWebhooks(postmap, chat, "")
+}
+
+// Queues an event for the user webhook and every endpoint whose filters match it.
+// Deliveries go through the outbox so they survive receiver downtime and restarts.
+func (mycli *MyClient) dispatchWebhooks(postmap map[string]interface{}, chat string, path string) {
+	txtid := strconv.Itoa(mycli.UserID)
+	eventType := postmap["type"].(string)
+
+	// call webhook
+	webhookurl := ""
+	myuserinfo, found := mycli.UserInfoCache.Get(txtid)
+	if !found {
+		log.Warn().Str("userid", txtid).Msg("Could not call webhook as there is no user information cached")
+	} else {
+		webhookurl = myuserinfo.(internalTypes.Values).Get("Webhook")
+	}
+
+	if !mycli.subscribed(eventType) {
+		log.Warn().Str("type", eventType).Msg("Skipping webhook. Not subscribed for this type")
+	} else if webhook.IsBroker(webhookurl) {
+		// Set before broker urls were rejected, brokers have to be webhook endpoints
+		log.Warn().Str("userid", txtid).Msg("Skipping webhook. Broker urls are only delivered to as webhook endpoints")
+	} else if webhookurl != "" {
+		format := webhook.FormatForm
+		media := webhook.MediaMultipart
+		err := mycli.Db.QueryRow("SELECT webhook_format, webhook_media FROM users WHERE id=?", mycli.UserID).Scan(&format, &media)
+		if err != nil {
+			log.Error().Err(err).Str("userid", txtid).Msg("Could not get webhook format")
+		}
+		log.Info().Str("url", webhookurl).Msg("Calling webhook")
+		err = mycli.Outbox.Enqueue(mycli.buildDelivery(webhookurl, format, media, postmap, path, nil))
+		if err != nil {
+			log.Error().Err(err).Str("userid", txtid).Msg("Could not queue webhook")
+		}
+	} else {
+		log.Warn().Str("userid", txtid).Msg("No webhook set for user")
+	}
+
+	endpoints, err := webhook.MatchingEndpoints(mycli.Db, mycli.UserID, eventType, chat)
+	if err != nil {
+		log.Error().Err(err).Str("userid", txtid).Msg("Could not get webhook endpoints")
+		return
+	}
+	for _, endpoint := range endpoints {
+		log.Info().Str("url", endpoint.Url).Int64("endpoint", endpoint.Id).Msg("Calling webhook endpoint")
+		d := mycli.buildDelivery(endpoint.Url, endpoint.Format, endpoint.Media, postmap, path, endpoint.Headers)
+		if webhook.IsBroker(endpoint.Url) {
+			d.Subject = webhook.RenderSubject(endpoint.Subject, mycli.UserID, eventType)
+		}
+		err = mycli.Outbox.Enqueue(d)
+		if err != nil {
+			log.Error().Err(err).Str("userid", txtid).Int64("endpoint", endpoint.Id).Msg("Could not queue webhook")
+		}
+	}
+}
+
+// Connection events came after the user webhook, which only gets them when subscribed by name
+var connectionEvents = []string{"Connected", "Disconnected", "LoggedOut"}
+
+// Tells whether the user webhook is subscribed to an event type
+func (mycli *MyClient) subscribed(eventType string) bool {
+	subscriptions := mycli.Session.Subscriptions()
+	if Find(subscriptions, eventType) {
+		return true
+	}
+	return Find(subscriptions, "All") && !Find(connectionEvents, eventType)
+}
+
+// Builds a delivery of an event in the format and media mode set for the receiving webhook.
+// Form deliveries carry the event in the jsonData field, JSON ones in a versioned envelope.
+func (mycli *MyClient) buildDelivery(url string, format string, media string, postmap map[string]interface{}, path string, headers map[string]string) webhook.Delivery {
+	d := webhook.Delivery{UserId: mycli.UserID, Url: url, Format: format, Headers: headers}
+
+	// Media is attached as a file unless it goes inline or as a link
+	var fileFields map[string]interface{}
+	if path != "" {
+		name := filepath.Base(path)
+		link := ""
+		if media == webhook.MediaURL {
+			link = mycli.Media.URL(mycli.UserID, name)
+		}
+		if media == webhook.MediaURL && link == "" {
+			log.Warn().Str("userid", strconv.Itoa(mycli.UserID)).Msg("No public URL set for media links, sending media as base64")
+			media = webhook.MediaBase64
+		}
+		switch media {
+		case webhook.MediaBase64:
+			content, err := os.ReadFile(path)
+			if err != nil {
+				log.Error().Err(err).Str("path", path).Msg("Could not read media for webhook")
+				break
 			}
+			fileFields = map[string]interface{}{"fileName": name, "mimetype": mime.TypeByExtension(filepath.Ext(name)), "data": base64.StdEncoding.EncodeToString(content)}
+		case webhook.MediaURL:
+			fileFields = map[string]interface{}{"fileName": name, "mimetype": mime.TypeByExtension(filepath.Ext(name)), "url": link}
+		default:
+			d.File = path
+		}
+	}
+
+	if format == webhook.FormatJSON {
+		envelope := mycli.envelope(postmap)
+		if fileFields != nil {
+			envelope["media"] = fileFields
+		}
+		body, _ := json.Marshal(envelope)
+		d.Body = string(body)
+		return d
+	}
+
+	values, _ := json.Marshal(postmap)
+	d.Payload = map[string]string{"jsonData": string(values)}
+	if fileFields != nil {
+		d.Payload["fileName"] = fileFields["fileName"].(string)
+		d.Payload["mimetype"] = fileFields["mimetype"].(string)
+		if data, ok := fileFields["data"]; ok {
+			d.Payload["fileData"] = data.(string)
 		} else {
-			log.Warn().Str("userid", strconv.Itoa(mycli.UserID)).Msg("No webhook set for user")
+			d.Payload["fileUrl"] = fileFields["url"].(string)
+		}
+	}
+	return d
+}
+
+// Wraps an event in the envelope sent to JSON webhooks and stream clients
+func (mycli *MyClient) envelope(postmap map[string]interface{}) map[string]interface{} {
+	payload := make(map[string]interface{})
+	for k, v := range postmap {
+		if k != "type" {
+			payload[k] = v
+		}
+	}
+	instance := ""
+	if mycli.WAClient.Store.ID != nil {
+		instance = mycli.WAClient.Store.ID.ToNonAD().String()
+	}
+	return map[string]interface{}{
+		"type":        postmap["type"],
+		"userId":      mycli.UserID,
+		"instanceJid": instance,
+		"timestamp":   time.Now().Unix(),
+		"payload":     payload,
+	}
+}
+
+// Sends an event to the stream clients of the user. Media is referenced by
+// name and, when a public URL is set, a signed link, never sent inline.
+func (mycli *MyClient) publishEvent(postmap map[string]interface{}, path string) {
+	envelope := mycli.envelope(postmap)
+	if path != "" {
+		name := filepath.Base(path)
+		media := map[string]interface{}{"fileName": name, "mimetype": mime.TypeByExtension(filepath.Ext(name))}
+		if link := mycli.Media.URL(mycli.UserID, name); link != "" {
+			media["url"] = link
 		}
+		envelope["media"] = media
 	}
+	mycli.Stream.Publish(mycli.UserID, postmap["type"].(string), envelope)
 }
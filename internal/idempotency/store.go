@@ -0,0 +1,72 @@
+package idempotency
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Header clients set so a retried request is not run twice
+const Header = "Idempotency-Key"
+
+// Header set on responses replayed from a previous request
+const ReplayedHeader = "Idempotent-Replayed"
+
+// How long keys are remembered
+const TTL = 24 * time.Hour
+
+// The first request made with a key, Code is 0 while it is still running
+type Record struct {
+	UserId   int
+	Key      string
+	Hash     string
+	Code     int
+	Response []byte
+	Created  int64
+}
+
+// Claims a key for a request. Returns started true if the caller now owns the key,
+// or the record of the request that used it before.
+func Begin(db *sql.DB, userid int, key string, hash string) (*Record, bool, error) {
+	now := time.Now()
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE created<?", now.Add(-TTL).Unix())
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := db.Exec("INSERT OR IGNORE INTO idempotency_keys (user_id,key,hash,created) VALUES (?,?,?,?)", userid, key, hash, now.Unix())
+	if err != nil {
+		return nil, false, err
+	}
+	if affected, _ := res.RowsAffected(); affected > 0 {
+		return nil, true, nil
+	}
+
+	r := Record{}
+	err = db.QueryRow("SELECT user_id,key,hash,code,response,created FROM idempotency_keys WHERE user_id=? AND key=?", userid, key).Scan(&r.UserId, &r.Key, &r.Hash, &r.Code, &r.Response, &r.Created)
+	if err == sql.ErrNoRows {
+		// Released meanwhile, claim it again
+		return Begin(db, userid, key, hash)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &r, false, nil
+}
+
+// Stores the response of the request owning a key
+func Finish(db *sql.DB, userid int, key string, code int, response []byte) error {
+	_, err := db.Exec("UPDATE idempotency_keys SET code=?, response=? WHERE user_id=? AND key=?", code, response, userid, key)
+	return err
+}
+
+// Releases a key so the request can be retried
+func Release(db *sql.DB, userid int, key string) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE user_id=? AND key=?", userid, key)
+	return err
+}
+
+// Releases the keys of requests that were running when the server stopped
+func ReleaseUnfinished(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE code=0")
+	return err
+}
@@ -0,0 +1,82 @@
+package messages
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// A poll sent or received, kept so the options of votes can be named
+type Poll struct {
+	ChatJid   string
+	MessageId string
+	Name      string
+	Options   []string
+	// How many options a voter can select, 0 for any number
+	Selectable int
+	Created    int64
+}
+
+// Gets the poll in message content, polls come in three message versions
+func PollOf(msg *waProto.Message) *waProto.PollCreationMessage {
+	switch {
+	case msg.GetPollCreationMessage() != nil:
+		return msg.GetPollCreationMessage()
+	case msg.GetPollCreationMessageV2() != nil:
+		return msg.GetPollCreationMessageV2()
+	case msg.GetPollCreationMessageV3() != nil:
+		return msg.GetPollCreationMessageV3()
+	}
+	return nil
+}
+
+// Stores a poll, polls already stored are left untouched
+func SavePoll(db *sql.DB, userid int, chat string, id string, poll *waProto.PollCreationMessage) error {
+	options := []string{}
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO polls (user_id,chat_jid,message_id,name,options,selectable,created) VALUES (?,?,?,?,?,?,?)", userid, chat, id, poll.GetName(), string(encoded), poll.GetSelectableOptionsCount(), time.Now().Unix())
+	return err
+}
+
+// Gets a stored poll by its Whatsapp id, returns nil if there is none
+func GetPoll(db *sql.DB, userid int, id string) (*Poll, error) {
+	p := Poll{}
+	options := ""
+	err := db.QueryRow("SELECT chat_jid,message_id,name,options,selectable,created FROM polls WHERE user_id=? AND message_id=? ORDER BY id DESC LIMIT 1", userid, id).Scan(&p.ChatJid, &p.MessageId, &p.Name, &options, &p.Selectable, &p.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(options), &p.Options)
+	return &p, err
+}
+
+// Names the options selected in a vote, which only carries their SHA-256 hashes.
+// Hashes matching no option are returned hex encoded.
+func (p *Poll) OptionNames(hashes [][]byte) []string {
+	names := []string{}
+	for _, hash := range hashes {
+		name := hex.EncodeToString(hash)
+		for _, option := range p.Options {
+			sum := sha256.Sum256([]byte(option))
+			if bytes.Equal(sum[:], hash) {
+				name = option
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,107 @@
+package messages
+
+import (
+	"database/sql"
+)
+
+// Statuses advanced by receipts, in order after StatusSent
+const (
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+	StatusPlayed    = "played"
+)
+
+// Delivery status of a sent message for one recipient, group messages get one per participant
+type Receipt struct {
+	Participant string
+	Status      string
+	Timestamp   int64
+}
+
+// Position of a status in the sent, delivered, read, played progression
+func statusRank(status string) int {
+	switch status {
+	case StatusSent:
+		return 1
+	case StatusDelivered:
+		return 2
+	case StatusRead:
+		return 3
+	case StatusPlayed:
+		return 4
+	}
+	return 0
+}
+
+// Advances the status of sent messages from a receipt, statuses never go backwards.
+// Receipts for messages that were not stored as sent are ignored.
+func ApplyReceipt(db *sql.DB, userid int, chat string, participant string, ids []string, status string, timestamp int64) error {
+	for _, id := range ids {
+		current := ""
+		err := db.QueryRow("SELECT status FROM messages WHERE user_id=? AND chat_jid=? AND message_id=? AND direction=?", userid, chat, id, DirectionOut).Scan(&current)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		previous := ""
+		err = db.QueryRow("SELECT status FROM message_receipts WHERE user_id=? AND chat_jid=? AND message_id=? AND participant_jid=?", userid, chat, id, participant).Scan(&previous)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if statusRank(status) > statusRank(previous) {
+			_, err = db.Exec("INSERT INTO message_receipts (user_id,chat_jid,message_id,participant_jid,status,timestamp) VALUES (?,?,?,?,?,?) ON CONFLICT(user_id,chat_jid,message_id,participant_jid) DO UPDATE SET status=excluded.status, timestamp=excluded.timestamp", userid, chat, id, participant, status, timestamp)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The message status is the furthest any recipient got
+		if statusRank(status) > statusRank(current) {
+			_, err = db.Exec("UPDATE messages SET status=? WHERE user_id=? AND chat_jid=? AND message_id=?", status, userid, chat, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Gets a stored message by its Whatsapp id along with its receipts, returns nil if there is none
+func Get(db *sql.DB, userid int, id string) (*Message, []Receipt, error) {
+	return get(db, "WHERE user_id=? AND message_id=? ORDER BY id DESC LIMIT 1", userid, id)
+}
+
+// Gets a stored message by its Whatsapp id in a chat along with its receipts, returns nil if the
+// chat has none
+func GetInChat(db *sql.DB, userid int, chat string, id string) (*Message, []Receipt, error) {
+	return get(db, "WHERE user_id=? AND chat_jid=? AND message_id=?", userid, chat, id)
+}
+
+func get(db *sql.DB, where string, args ...interface{}) (*Message, []Receipt, error) {
+	m := Message{}
+	err := db.QueryRow("SELECT id,user_id,chat_jid,sender_jid,message_id,timestamp,type,text,media_mimetype,media_filename,media_size,media_path,quoted_id,direction,status,edited,revoked FROM messages "+where, args...).Scan(&m.Id, &m.UserId, &m.ChatJid, &m.SenderJid, &m.MessageId, &m.Timestamp, &m.Type, &m.Text, &m.MediaMimetype, &m.MediaFileName, &m.MediaSize, &m.MediaPath, &m.QuotedId, &m.Direction, &m.Status, &m.Edited, &m.Revoked)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query("SELECT participant_jid,status,timestamp FROM message_receipts WHERE user_id=? AND chat_jid=? AND message_id=? ORDER BY participant_jid", m.UserId, m.ChatJid, m.MessageId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	receipts := []Receipt{}
+	for rows.Next() {
+		rc := Receipt{}
+		err = rows.Scan(&rc.Participant, &rc.Status, &rc.Timestamp)
+		if err != nil {
+			return nil, nil, err
+		}
+		receipts = append(receipts, rc)
+	}
+	return &m, receipts, rows.Err()
+}
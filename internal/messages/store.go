@@ -0,0 +1,259 @@
+package messages
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Message directions
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// Message statuses
+const (
+	StatusReceived = "received"
+	StatusSent     = "sent"
+)
+
+// A sent or received message as stored in the messages table
+type Message struct {
+	Id            int64
+	UserId        int
+	ChatJid       string
+	SenderJid     string
+	MessageId     string
+	Timestamp     int64
+	Type          string
+	Text          string
+	MediaMimetype string
+	MediaFileName string
+	MediaSize     uint64
+	MediaPath     string
+	QuotedId      string
+	Direction     string
+	Status        string
+	// When the text was last edited and when the message was revoked, 0 if never
+	Edited  int64
+	Revoked int64
+}
+
+// Filters for listing stored messages, zero values are ignored
+type Filter struct {
+	UserId    int
+	ChatJid   string
+	Direction string
+	Since     int64
+	Until     int64
+	// Only messages stored before this id, used as pagination cursor
+	Before int64
+	Limit  int
+}
+
+// Builds a message from a received message event
+func FromEvent(userid int, evt *events.Message) Message {
+	m := Message{
+		UserId:    userid,
+		ChatJid:   evt.Info.Chat.String(),
+		SenderJid: evt.Info.Sender.ToNonAD().String(),
+		MessageId: evt.Info.ID,
+		Timestamp: evt.Info.Timestamp.Unix(),
+		Direction: DirectionIn,
+		Status:    StatusReceived,
+	}
+	// Messages sent from the phone also come as events
+	if evt.Info.IsFromMe {
+		m.Direction = DirectionOut
+		m.Status = StatusSent
+	}
+	describe(&m, evt.Message)
+	return m
+}
+
+// Builds a message from one sent through the API
+func FromSent(userid int, chat types.JID, sender types.JID, id string, timestamp time.Time, msg *waProto.Message) Message {
+	m := Message{
+		UserId:    userid,
+		ChatJid:   chat.String(),
+		SenderJid: sender.ToNonAD().String(),
+		MessageId: id,
+		Timestamp: timestamp.Unix(),
+		Direction: DirectionOut,
+		Status:    StatusSent,
+	}
+	describe(&m, msg)
+	return m
+}
+
+// Fills type, text, media and quote fields from message content
+func describe(m *Message, msg *waProto.Message) {
+	if msg == nil {
+		return
+	}
+	// Unwrap view once and ephemeral containers
+	if inner := msg.GetViewOnceMessage().GetMessage(); inner != nil {
+		msg = inner
+	}
+	if inner := msg.GetEphemeralMessage().GetMessage(); inner != nil {
+		msg = inner
+	}
+
+	var ctx *waProto.ContextInfo
+	switch {
+	case msg.Conversation != nil:
+		m.Type = "text"
+		m.Text = msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		m.Type = "text"
+		m.Text = msg.ExtendedTextMessage.GetText()
+		ctx = msg.ExtendedTextMessage.GetContextInfo()
+	case msg.ImageMessage != nil:
+		m.Type = "image"
+		m.Text = msg.ImageMessage.GetCaption()
+		m.MediaMimetype = msg.ImageMessage.GetMimetype()
+		m.MediaSize = msg.ImageMessage.GetFileLength()
+		ctx = msg.ImageMessage.GetContextInfo()
+	case msg.VideoMessage != nil:
+		m.Type = "video"
+		m.Text = msg.VideoMessage.GetCaption()
+		m.MediaMimetype = msg.VideoMessage.GetMimetype()
+		m.MediaSize = msg.VideoMessage.GetFileLength()
+		ctx = msg.VideoMessage.GetContextInfo()
+	case msg.AudioMessage != nil:
+		m.Type = "audio"
+		m.MediaMimetype = msg.AudioMessage.GetMimetype()
+		m.MediaSize = msg.AudioMessage.GetFileLength()
+		ctx = msg.AudioMessage.GetContextInfo()
+	case msg.DocumentMessage != nil:
+		m.Type = "document"
+		m.Text = msg.DocumentMessage.GetCaption()
+		m.MediaMimetype = msg.DocumentMessage.GetMimetype()
+		m.MediaFileName = msg.DocumentMessage.GetFileName()
+		m.MediaSize = msg.DocumentMessage.GetFileLength()
+		ctx = msg.DocumentMessage.GetContextInfo()
+	case msg.StickerMessage != nil:
+		m.Type = "sticker"
+		m.MediaMimetype = msg.StickerMessage.GetMimetype()
+		m.MediaSize = msg.StickerMessage.GetFileLength()
+		ctx = msg.StickerMessage.GetContextInfo()
+	case msg.LocationMessage != nil:
+		m.Type = "location"
+		m.Text = msg.LocationMessage.GetName()
+		ctx = msg.LocationMessage.GetContextInfo()
+	case msg.ContactMessage != nil:
+		m.Type = "contact"
+		m.Text = msg.ContactMessage.GetDisplayName()
+		ctx = msg.ContactMessage.GetContextInfo()
+	case msg.ReactionMessage != nil:
+		m.Type = "reaction"
+		m.Text = msg.ReactionMessage.GetText()
+		m.QuotedId = msg.ReactionMessage.GetKey().GetId()
+	case msg.ButtonsMessage != nil:
+		m.Type = "buttons"
+		m.Text = msg.ButtonsMessage.GetContentText()
+		ctx = msg.ButtonsMessage.GetContextInfo()
+	case msg.ListMessage != nil:
+		m.Type = "list"
+		m.Text = msg.ListMessage.GetDescription()
+		ctx = msg.ListMessage.GetContextInfo()
+	case msg.GroupInviteMessage != nil:
+		m.Type = "group_invite"
+		m.Text = msg.GroupInviteMessage.GetGroupName()
+		ctx = msg.GroupInviteMessage.GetContextInfo()
+	case PollOf(msg) != nil:
+		m.Type = "poll"
+		m.Text = PollOf(msg).GetName()
+	case msg.PollUpdateMessage != nil:
+		m.Type = "poll_vote"
+		m.QuotedId = msg.PollUpdateMessage.GetPollCreationMessageKey().GetId()
+	case msg.ProtocolMessage != nil:
+		m.Type = "protocol"
+	default:
+		m.Type = "unknown"
+	}
+	if ctx != nil && ctx.StanzaId != nil {
+		m.QuotedId = ctx.GetStanzaId()
+	}
+}
+
+// Stores a message, messages already stored are left untouched
+func Save(db *sql.DB, m Message) error {
+	sqlStmt := `INSERT OR IGNORE INTO messages (user_id,chat_jid,sender_jid,message_id,timestamp,type,text,media_mimetype,media_filename,media_size,media_path,quoted_id,direction,status) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)`
+	_, err := db.Exec(sqlStmt, m.UserId, m.ChatJid, m.SenderJid, m.MessageId, m.Timestamp, m.Type, m.Text, m.MediaMimetype, m.MediaFileName, m.MediaSize, m.MediaPath, m.QuotedId, m.Direction, m.Status)
+	return err
+}
+
+// Records where the media of a received message was saved
+func SetMediaPath(db *sql.DB, userid int, chat string, id string, path string) error {
+	_, err := db.Exec("UPDATE messages SET media_path=? WHERE user_id=? AND chat_jid=? AND message_id=?", path, userid, chat, id)
+	return err
+}
+
+// Replaces the text of a stored message after its sender edited it
+func SetEdited(db *sql.DB, userid int, chat string, id string, text string, timestamp int64) error {
+	_, err := db.Exec("UPDATE messages SET text=?, edited=? WHERE user_id=? AND chat_jid=? AND message_id=?", text, timestamp, userid, chat, id)
+	return err
+}
+
+// Marks a stored message as revoked, its text is cleared as the sender deleted it for everyone
+func SetRevoked(db *sql.DB, userid int, chat string, id string, timestamp int64) error {
+	_, err := db.Exec("UPDATE messages SET text='', revoked=? WHERE user_id=? AND chat_jid=? AND message_id=?", timestamp, userid, chat, id)
+	return err
+}
+
+// Gets the text or caption of message content
+func TextOf(msg *waProto.Message) string {
+	m := Message{}
+	describe(&m, msg)
+	return m.Text
+}
+
+// Lists stored messages matching a filter, newest first
+func List(db *sql.DB, f Filter) ([]Message, error) {
+	where := []string{"user_id=?"}
+	args := []interface{}{f.UserId}
+	if f.ChatJid != "" {
+		where = append(where, "chat_jid=?")
+		args = append(args, f.ChatJid)
+	}
+	if f.Direction != "" {
+		where = append(where, "direction=?")
+		args = append(args, f.Direction)
+	}
+	if f.Since > 0 {
+		where = append(where, "timestamp>=?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		where = append(where, "timestamp<=?")
+		args = append(args, f.Until)
+	}
+	if f.Before > 0 {
+		where = append(where, "id<?")
+		args = append(args, f.Before)
+	}
+	args = append(args, f.Limit)
+
+	rows, err := db.Query("SELECT id,user_id,chat_jid,sender_jid,message_id,timestamp,type,text,media_mimetype,media_filename,media_size,media_path,quoted_id,direction,status,edited,revoked FROM messages WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Message{}
+	for rows.Next() {
+		m := Message{}
+		err = rows.Scan(&m.Id, &m.UserId, &m.ChatJid, &m.SenderJid, &m.MessageId, &m.Timestamp, &m.Type, &m.Text, &m.MediaMimetype, &m.MediaFileName, &m.MediaSize, &m.MediaPath, &m.QuotedId, &m.Direction, &m.Status, &m.Edited, &m.Revoked)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
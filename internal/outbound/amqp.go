@@ -0,0 +1,103 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Consumes a durable AMQP 0-9-1 queue, declaring it if needed. Results are published
+// to the exchange set with the exchange query parameter of the URL (amq.topic by
+// default) with the result subject as routing key. Messages are acknowledged once
+// handled, unacknowledged ones are redelivered by the broker.
+type AmqpSource struct {
+	conn          *amqp.Connection
+	channel       *amqp.Channel
+	exchange      string
+	queue         string
+	resultSubject string
+}
+
+func dialAmqp(u *url.URL, queue string, resultSubject string) (*AmqpSource, error) {
+	query := u.Query()
+	exchange := query.Get("exchange")
+	if exchange == "" {
+		exchange = "amq.topic"
+	}
+	query.Del("exchange")
+	dial := *u
+	dial.RawQuery = query.Encode()
+
+	conn, err := amqp.Dial(dial.String())
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &AmqpSource{conn: conn, channel: channel, exchange: exchange, queue: queue, resultSubject: resultSubject}, nil
+}
+
+func (a *AmqpSource) Consume(ctx context.Context, handle Handler) error {
+	_, err := a.channel.QueueDeclare(a.queue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	// Messages are sent one at a time, do not hold more than the one being sent
+	err = a.channel.Qos(1, 0, false)
+	if err != nil {
+		return err
+	}
+	deliveries, err := a.channel.Consume(a.queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("AMQP channel closed")
+			}
+			result, handled := handle(ctx, d.Body)
+			if !handled {
+				return ctx.Err()
+			}
+			if a.resultSubject != "" {
+				pubctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				err = a.channel.PublishWithContext(pubctx, a.exchange, a.resultSubject, false, false, amqp.Publishing{
+					ContentType:   "application/json",
+					CorrelationId: d.CorrelationId,
+					Timestamp:     time.Now(),
+					Body:          result,
+				})
+				cancel()
+				if err != nil {
+					return err
+				}
+			}
+			if d.ReplyTo != "" {
+				a.channel.PublishWithContext(ctx, "", d.ReplyTo, false, false, amqp.Publishing{
+					ContentType:   "application/json",
+					CorrelationId: d.CorrelationId,
+					Body:          result,
+				})
+			}
+			err = d.Ack(false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *AmqpSource) Close() {
+	a.conn.Close()
+}
@@ -0,0 +1,183 @@
+package outbound
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Default subject, routing key or stream send results are published to
+const DefaultResultSubject = "wuzapi.{userid}.SendResult"
+
+// Broker queue a user receives messages to send from
+type Config struct {
+	UserId int
+	Url    string
+	// Subject, queue or stream consumed
+	Subject string
+	// Where results are published, {userid} is replaced by the user id
+	ResultSubject string
+	Enabled       bool
+	Created       int64
+}
+
+// Handles a consumed message, returning the result to publish. handled is false
+// if the message was not processed and should be left for a later delivery.
+type Handler func(ctx context.Context, body []byte) (result []byte, handled bool)
+
+// A broker connection messages are consumed from and results published to
+type Source interface {
+	// Calls handle for every message until ctx is done or the connection fails.
+	// Messages are acknowledged once handled and their result published.
+	Consume(ctx context.Context, handle Handler) error
+	Close()
+}
+
+// Connects to the broker of a consumer configuration
+func Dial(cfg *Config) (Source, error) {
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, err
+	}
+	resultSubject := strings.ReplaceAll(cfg.ResultSubject, "{userid}", strconv.Itoa(cfg.UserId))
+	switch u.Scheme {
+	case "nats", "tls":
+		return dialNats(cfg.Url, cfg.Subject, resultSubject)
+	case "amqp", "amqps":
+		return dialAmqp(u, cfg.Subject, resultSubject)
+	case "redis", "rediss":
+		return dialRedis(u, cfg.Subject, resultSubject)
+	}
+	return nil, errors.New("Unsupported broker: " + u.Scheme)
+}
+
+// Gets the consumer configuration of a user, returns nil if there is none
+func GetConfig(db *sql.DB, userid int) (*Config, error) {
+	c := Config{}
+	err := db.QueryRow("SELECT user_id,url,subject,result_subject,enabled,created FROM send_consumers WHERE user_id=?", userid).Scan(&c.UserId, &c.Url, &c.Subject, &c.ResultSubject, &c.Enabled, &c.Created)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Creates or replaces the consumer configuration of a user
+func SaveConfig(db *sql.DB, c *Config) error {
+	if c.Created == 0 {
+		c.Created = time.Now().Unix()
+	}
+	_, err := db.Exec("INSERT OR REPLACE INTO send_consumers (user_id,url,subject,result_subject,enabled,created) VALUES (?,?,?,?,?,?)", c.UserId, c.Url, c.Subject, c.ResultSubject, c.Enabled, c.Created)
+	return err
+}
+
+// Deletes the consumer configuration of a user
+func DeleteConfig(db *sql.DB, userid int) (bool, error) {
+	res, err := db.Exec("DELETE FROM send_consumers WHERE user_id=?", userid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+type running struct {
+	cancel context.CancelFunc
+}
+
+// Runs one consumer per user while its session is up
+type Manager struct {
+	Db *sql.DB
+
+	mu      sync.Mutex
+	running map[int]*running
+}
+
+func NewManager(db *sql.DB) *Manager {
+	return &Manager{Db: db, running: make(map[int]*running)}
+}
+
+// Starts consuming with the saved configuration of a user until ctx is done,
+// replacing a consumer already running for it. Does nothing if the user has no
+// enabled configuration.
+func (m *Manager) Start(ctx context.Context, userid int, handle Handler) error {
+	m.Stop(userid)
+
+	cfg, err := GetConfig(m.Db, userid)
+	if err != nil {
+		return err
+	}
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &running{cancel: cancel}
+	m.mu.Lock()
+	m.running[userid] = r
+	m.mu.Unlock()
+
+	go func() {
+		m.run(ctx, cfg, handle)
+		m.mu.Lock()
+		if m.running[userid] == r {
+			delete(m.running, userid)
+		}
+		m.mu.Unlock()
+	}()
+	return nil
+}
+
+// Stops the consumer of a user
+func (m *Manager) Stop(userid int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.running[userid]; ok {
+		r.cancel()
+		delete(m.running, userid)
+	}
+}
+
+// Tells if a consumer is running for a user
+func (m *Manager) Running(userid int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.running[userid]
+	return ok
+}
+
+// Consumes until ctx is done, reconnecting with backoff when the broker fails
+func (m *Manager) run(ctx context.Context, cfg *Config, handle Handler) {
+	delay := time.Second
+	for {
+		source, err := Dial(cfg)
+		if err == nil {
+			log.Info().Int("userid", cfg.UserId).Str("subject", cfg.Subject).Msg("Consuming messages to send")
+			err = source.Consume(ctx, handle)
+			source.Close()
+			delay = time.Second
+		}
+		if ctx.Err() != nil {
+			log.Info().Int("userid", cfg.UserId).Msg("Stopped consuming messages to send")
+			return
+		}
+		log.Warn().Err(err).Int("userid", cfg.UserId).Str("retry_in", delay.String()).Msg("Send consumer failed")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
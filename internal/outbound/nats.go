@@ -0,0 +1,57 @@
+package outbound
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Consumes a NATS subject in the wuzapi queue group. Results are published to the
+// result subject and, for requests, to their reply subject. Core NATS does not
+// redeliver, messages in flight when the session stops are lost.
+type NatsSource struct {
+	conn          *nats.Conn
+	subject       string
+	resultSubject string
+}
+
+func dialNats(rawurl string, subject string, resultSubject string) (*NatsSource, error) {
+	conn, err := nats.Connect(rawurl, nats.Name("wuzapi"), nats.Timeout(10*time.Second), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NatsSource{conn: conn, subject: subject, resultSubject: resultSubject}, nil
+}
+
+func (n *NatsSource) Consume(ctx context.Context, handle Handler) error {
+	sub, err := n.conn.QueueSubscribeSync(n.subject, "wuzapi")
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		result, handled := handle(ctx, msg.Data)
+		if !handled {
+			return ctx.Err()
+		}
+		if msg.Reply != "" {
+			n.conn.Publish(msg.Reply, result)
+		}
+		if n.resultSubject != "" {
+			err = n.conn.Publish(n.resultSubject, result)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (n *NatsSource) Close() {
+	n.conn.Close()
+}
@@ -0,0 +1,81 @@
+package outbound
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Consumes a Redis stream in the wuzapi consumer group, reading the message from the
+// payload field of each entry. Results are added to the result stream in the payload
+// field. Entries are acknowledged once handled, pending ones are read again on restart.
+type RedisSource struct {
+	client        *redis.Client
+	stream        string
+	resultSubject string
+}
+
+func dialRedis(u *url.URL, stream string, resultSubject string) (*RedisSource, error) {
+	query := u.Query()
+	query.Del("maxlen")
+	dial := *u
+	dial.RawQuery = query.Encode()
+
+	options, err := redis.ParseURL(dial.String())
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSource{client: redis.NewClient(options), stream: stream, resultSubject: resultSubject}, nil
+}
+
+func (r *RedisSource) Consume(ctx context.Context, handle Handler) error {
+	err := r.client.XGroupCreateMkStream(ctx, r.stream, "wuzapi", "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	// Entries read before a restart but never acknowledged come first
+	last := "0"
+	for {
+		streams, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    "wuzapi",
+			Consumer: "wuzapi",
+			Streams:  []string{r.stream, last},
+			Count:    10,
+			Block:    5 * time.Second,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == redis.Nil || len(streams) == 0 || len(streams[0].Messages) == 0 {
+			// No pending entries left, or none arrived while blocking, wait for new ones
+			last = ">"
+			continue
+		}
+
+		for _, entry := range streams[0].Messages {
+			payload, _ := entry.Values["payload"].(string)
+			result, handled := handle(ctx, []byte(payload))
+			if !handled {
+				return ctx.Err()
+			}
+			if r.resultSubject != "" {
+				err = r.client.XAdd(ctx, &redis.XAddArgs{Stream: r.resultSubject, Values: []interface{}{"payload", string(result)}}).Err()
+				if err != nil {
+					return err
+				}
+			}
+			err = r.client.XAck(ctx, r.stream, "wuzapi", entry.ID).Err()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *RedisSource) Close() {
+	r.client.Close()
+}
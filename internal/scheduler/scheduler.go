@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	StatusScheduled = "scheduled"
+	StatusDone      = "done"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Returned by a Func when the message can not be handed over yet, it is retried later
+var ErrNotReady = errors.New("Session not ready")
+
+// A /chat/send payload to send at a given time, once or on a cron schedule
+type Message struct {
+	Id     int64
+	UserId int
+	// Message type of the /chat/send endpoint: text, image, location...
+	Type    string
+	Payload string
+	// Next time the message is sent, in unix seconds
+	SendAt int64
+	// Standard cron expression for recurring messages, CRON_TZ=Area/City can prefix it
+	Cron        string
+	Status      string
+	Runs        int
+	LastRun     int64
+	LastError   string
+	LastQueueId int64
+	// When the message was due and waiting for the session, in unix seconds, 0 if it is not late
+	LateSince int64
+	Created   int64
+}
+
+// Hands a due message over to be sent, returning its send queue id
+type Func func(m *Message) (int64, error)
+
+var parser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Parses a cron expression, returns the next time it fires after t
+func Next(expr string, t time.Time) (time.Time, error) {
+	schedule, err := parser.Parse(strings.TrimSpace(expr))
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := schedule.Next(t)
+	if next.IsZero() {
+		return next, errors.New("Cron expression never fires")
+	}
+	return next, nil
+}
+
+// Sends stored messages when they are due, surviving restarts
+type Scheduler struct {
+	Db *sql.DB
+	// How long a due message waits for its session before the run is given up
+	MaxDelay time.Duration
+
+	wake chan struct{}
+}
+
+func NewScheduler(db *sql.DB) *Scheduler {
+	return &Scheduler{Db: db, MaxDelay: 12 * time.Hour, wake: make(chan struct{}, 1)}
+}
+
+// Stores a message to send at m.SendAt, or at the next time m.Cron fires if SendAt is 0
+func (s *Scheduler) Add(m *Message) error {
+	if m.SendAt == 0 {
+		next, err := Next(m.Cron, time.Now())
+		if err != nil {
+			return err
+		}
+		m.SendAt = next.Unix()
+	}
+	m.Status = StatusScheduled
+	m.Created = time.Now().Unix()
+	res, err := s.Db.Exec("INSERT INTO scheduled_messages (user_id,type,payload,send_at,cron,status,created) VALUES (?,?,?,?,?,?,?)", m.UserId, m.Type, m.Payload, m.SendAt, m.Cron, m.Status, m.Created)
+	if err != nil {
+		return err
+	}
+	m.Id, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Gets a scheduled message, returns nil if there is none
+func (s *Scheduler) Get(userid int, id int64) (*Message, error) {
+	m, err := scanMessage(s.Db.QueryRow("SELECT "+messageColumns+" FROM scheduled_messages WHERE user_id=? AND id=?", userid, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return m, err
+}
+
+// Lists scheduled messages with a status, newest first, before an id if set
+func (s *Scheduler) List(userid int, status string, before int64, limit int) ([]Message, error) {
+	query := "SELECT " + messageColumns + " FROM scheduled_messages WHERE user_id=?"
+	args := []interface{}{userid}
+	if status != "" {
+		query += " AND status=?"
+		args = append(args, status)
+	}
+	if before > 0 {
+		query += " AND id<?"
+		args = append(args, before)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *m)
+	}
+	return list, rows.Err()
+}
+
+// Cancels a scheduled message, returns false if it is not scheduled anymore
+func (s *Scheduler) Cancel(userid int, id int64) (bool, error) {
+	res, err := s.Db.Exec("UPDATE scheduled_messages SET status=? WHERE user_id=? AND id=? AND status=?", StatusCancelled, userid, id, StatusScheduled)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Hands due messages to fire until ctx is done
+func (s *Scheduler) Run(ctx context.Context, fire Func) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.dispatch(fire, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Scheduler) dispatch(fire Func, now time.Time) {
+	rows, err := s.Db.Query("SELECT "+messageColumns+" FROM scheduled_messages WHERE status=? AND send_at<=? ORDER BY send_at,id LIMIT 100", StatusScheduled, now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read scheduled messages")
+		return
+	}
+	var due []*Message
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not read scheduled messages")
+			break
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+
+	for _, m := range due {
+		queueId, err := fire(m)
+		if err == ErrNotReady {
+			if m.LateSince == 0 {
+				m.LateSince = m.SendAt
+			}
+			if now.Sub(time.Unix(m.LateSince, 0)) < s.MaxDelay {
+				// Try again once the session is back
+				_, err = s.Db.Exec("UPDATE scheduled_messages SET send_at=?, late_since=? WHERE id=?", now.Add(30*time.Second).Unix(), m.LateSince, m.Id)
+				if err != nil {
+					log.Error().Err(err).Int64("id", m.Id).Msg("Could not update scheduled message")
+				}
+				continue
+			}
+			err = errors.New("Session was not ready within " + s.MaxDelay.String())
+		}
+		m.LateSince = 0
+
+		m.Runs++
+		m.LastRun = now.Unix()
+		m.LastQueueId = queueId
+		m.LastError = ""
+		if err != nil {
+			m.LastError = err.Error()
+			log.Warn().Err(err).Int("userid", m.UserId).Int64("id", m.Id).Msg("Scheduled message failed")
+		}
+		if m.Cron != "" {
+			// Runs missed while down are not caught up, the schedule goes on from now
+			next, err := Next(m.Cron, now)
+			if err != nil {
+				m.Status = StatusFailed
+				m.LastError = err.Error()
+			} else {
+				m.SendAt = next.Unix()
+			}
+		} else if m.LastError != "" {
+			m.Status = StatusFailed
+		} else {
+			m.Status = StatusDone
+		}
+
+		_, err = s.Db.Exec("UPDATE scheduled_messages SET send_at=?, status=?, runs=?, last_run=?, last_error=?, last_queue_id=?, late_since=? WHERE id=? AND status=?", m.SendAt, m.Status, m.Runs, m.LastRun, m.LastError, m.LastQueueId, m.LateSince, m.Id, StatusScheduled)
+		if err != nil {
+			log.Error().Err(err).Int64("id", m.Id).Msg("Could not update scheduled message")
+		}
+	}
+}
+
+const messageColumns = "id,user_id,type,payload,send_at,cron,status,runs,last_run,last_error,last_queue_id,late_since,created"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row scanner) (*Message, error) {
+	m := Message{}
+	err := row.Scan(&m.Id, &m.UserId, &m.Type, &m.Payload, &m.SendAt, &m.Cron, &m.Status, &m.Runs, &m.LastRun, &m.LastError, &m.LastQueueId, &m.LateSince, &m.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"wuzapi/internal/schema"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestDispatch(t *testing.T) {
+	due := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	notReady := func(m *Message) (int64, error) { return 0, ErrNotReady }
+	queued := func(m *Message) (int64, error) { return 42, nil }
+	failing := func(m *Message) (int64, error) { return 0, errors.New("Missing Phone in Payload") }
+
+	tests := []struct {
+		name      string
+		cron      string
+		lateSince int64
+		now       time.Time
+		fire      Func
+		// State of the message after dispatch
+		status      string
+		sendAt      time.Time
+		lateSinceAt int64
+		runs        int
+		lastError   string
+	}{
+		{"sent", "", 0, due, queued, StatusDone, due, 0, 1, ""},
+		{"failed", "", 0, due, failing, StatusFailed, due, 0, 1, "Missing Phone in Payload"},
+		{"session not ready", "", 0, due.Add(time.Minute), notReady, StatusScheduled, due.Add(time.Minute + 30*time.Second), due.Unix(), 0, ""},
+		{"still waiting for the session", "", due.Unix(), due.Add(11 * time.Hour), notReady, StatusScheduled, due.Add(11*time.Hour + 30*time.Second), due.Unix(), 0, ""},
+		{"sent late", "", due.Unix(), due.Add(11 * time.Hour), queued, StatusDone, due, 0, 1, ""},
+		{"one time message given up", "", due.Unix(), due.Add(12 * time.Hour), notReady, StatusFailed, due, 0, 1, "Session was not ready within 12h0m0s"},
+		{"recurring run given up", "0 9 * * *", due.Unix(), due.Add(12 * time.Hour), notReady, StatusScheduled, due.Add(24 * time.Hour), 0, 1, "Session was not ready within 12h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			err = schema.Create(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewScheduler(db)
+
+			// The send time of a late message moved on while it waited
+			sendAt := due
+			if tt.lateSince != 0 {
+				sendAt = tt.now.Add(-10 * time.Second)
+			}
+			m := &Message{UserId: 1, Type: "text", Payload: "{}", SendAt: sendAt.Unix(), Cron: tt.cron}
+			err = s.Add(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("UPDATE scheduled_messages SET late_since=? WHERE id=?", tt.lateSince, m.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.dispatch(tt.fire, tt.now)
+
+			got, err := s.Get(1, m.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status {
+				t.Errorf("status %s, want %s", got.Status, tt.status)
+			}
+			if tt.status == StatusScheduled && got.SendAt != tt.sendAt.Unix() {
+				t.Errorf("send at %v, want %v", time.Unix(got.SendAt, 0).UTC(), tt.sendAt)
+			}
+			if got.LateSince != tt.lateSinceAt {
+				t.Errorf("late since %d, want %d", got.LateSince, tt.lateSinceAt)
+			}
+			if got.Runs != tt.runs {
+				t.Errorf("%d runs, want %d", got.Runs, tt.runs)
+			}
+			if got.LastError != tt.lastError {
+				t.Errorf("last error %q, want %q", got.LastError, tt.lastError)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Creates the tables of the users database, or adds what is missing to those of an older version
+func Create(db *sql.DB) error {
+	sqlStmt := `CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, token TEXT NOT NULL, webhook TEXT NOT NULL default "", jid TEXT NOT NULL default "", qrcode TEXT NOT NULL default "", connected INTEGER, expiration INTEGER, events TEXT NOT NULL default "All");`
+	_, err := db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS tokens (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, name TEXT NOT NULL, prefix TEXT NOT NULL, salt TEXT NOT NULL, hash TEXT NOT NULL, scopes TEXT NOT NULL default "*", created INTEGER NOT NULL default 0, UNIQUE(user_id, name)); CREATE INDEX IF NOT EXISTS tokens_prefix ON tokens (prefix);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS messages (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, chat_jid TEXT NOT NULL, sender_jid TEXT NOT NULL default "", message_id TEXT NOT NULL, timestamp INTEGER NOT NULL default 0, type TEXT NOT NULL default "", text TEXT NOT NULL default "", media_mimetype TEXT NOT NULL default "", media_filename TEXT NOT NULL default "", media_size INTEGER NOT NULL default 0, media_path TEXT NOT NULL default "", quoted_id TEXT NOT NULL default "", direction TEXT NOT NULL, status TEXT NOT NULL default "", UNIQUE(user_id, chat_jid, message_id)); CREATE INDEX IF NOT EXISTS messages_chat ON messages (user_id, chat_jid, timestamp);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	for _, column := range []string{"edited", "revoked"} {
+		err = addColumn(db, "messages", column, "INTEGER NOT NULL default 0")
+		if err != nil {
+			return fmt.Errorf("%q: adding %s to messages", err, column)
+		}
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS polls (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, chat_jid TEXT NOT NULL, message_id TEXT NOT NULL, name TEXT NOT NULL default "", options TEXT NOT NULL default "[]", selectable INTEGER NOT NULL default 0, created INTEGER NOT NULL default 0, UNIQUE(user_id, chat_jid, message_id)); CREATE INDEX IF NOT EXISTS polls_message ON polls (user_id, message_id);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS group_snapshots (user_id INTEGER NOT NULL, group_jid TEXT NOT NULL, name TEXT NOT NULL default "", topic TEXT NOT NULL default "", locked INTEGER NOT NULL default 0, announce INTEGER NOT NULL default 0, ephemeral INTEGER NOT NULL default 0, updated INTEGER NOT NULL default 0, PRIMARY KEY (user_id, group_jid));`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS message_receipts (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, chat_jid TEXT NOT NULL, message_id TEXT NOT NULL, participant_jid TEXT NOT NULL, status TEXT NOT NULL, timestamp INTEGER NOT NULL default 0, UNIQUE(user_id, chat_jid, message_id, participant_jid));`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhook_queue (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, url TEXT NOT NULL, payload TEXT NOT NULL, file TEXT NOT NULL default "", attempts INTEGER NOT NULL default 0, next_attempt INTEGER NOT NULL default 0, last_error TEXT NOT NULL default "", created INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS webhook_queue_next ON webhook_queue (next_attempt);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhook_dead_letters (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, url TEXT NOT NULL, payload TEXT NOT NULL, file TEXT NOT NULL default "", attempts INTEGER NOT NULL default 0, last_error TEXT NOT NULL default "", created INTEGER NOT NULL default 0, failed INTEGER NOT NULL default 0);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	// Columns added after the webhook tables were first created
+	for _, table := range []string{"webhook_queue", "webhook_dead_letters"} {
+		for _, column := range [][2]string{{"headers", `TEXT NOT NULL default ""`}, {"format", `TEXT NOT NULL default "form"`}, {"body", `TEXT NOT NULL default ""`}, {"subject", `TEXT NOT NULL default ""`}} {
+			err = addColumn(db, table, column[0], column[1])
+			if err != nil {
+				return fmt.Errorf("%q: adding %s to %s", err, column[0], table)
+			}
+		}
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhooks (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, url TEXT NOT NULL, events TEXT NOT NULL default "All", chats TEXT NOT NULL default "", enabled INTEGER NOT NULL default 1, headers TEXT NOT NULL default "", created INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS webhooks_user ON webhooks (user_id);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	for _, table := range []string{"webhooks", "users"} {
+		prefix := ""
+		if table == "users" {
+			prefix = "webhook_"
+		}
+		for _, column := range [][2]string{{"format", `TEXT NOT NULL default "form"`}, {"media", `TEXT NOT NULL default "multipart"`}} {
+			err = addColumn(db, table, prefix+column[0], column[1])
+			if err != nil {
+				return fmt.Errorf("%q: adding %s to %s", err, prefix+column[0], table)
+			}
+		}
+	}
+
+	err = addColumn(db, "webhooks", "subject", `TEXT NOT NULL default ""`)
+	if err != nil {
+		return fmt.Errorf("%q: adding subject to webhooks", err)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS settings (name TEXT NOT NULL PRIMARY KEY, value TEXT NOT NULL default "");`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS webhook_secrets (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, secret TEXT NOT NULL, created INTEGER NOT NULL default 0, expires INTEGER NOT NULL default 0);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS send_consumers (user_id INTEGER NOT NULL PRIMARY KEY, url TEXT NOT NULL, subject TEXT NOT NULL, result_subject TEXT NOT NULL default "", enabled INTEGER NOT NULL default 1, created INTEGER NOT NULL default 0);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS send_queue (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, recipient TEXT NOT NULL, message_id TEXT NOT NULL default "", type TEXT NOT NULL default "", message BLOB NOT NULL, status TEXT NOT NULL default "pending", error TEXT NOT NULL default "", created INTEGER NOT NULL default 0, sent INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS send_queue_status ON send_queue (user_id, status, id);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	// Client supplied ids are used once, failed and cancelled messages can be sent again with the same id.
+	// Items queued before the index reusing an id are failed first, the oldest one keeps it.
+	sqlStmt = `UPDATE send_queue SET status='failed', error='Duplicate message id' WHERE message_id!='' AND status NOT IN ('failed','cancelled') AND EXISTS (SELECT 1 FROM send_queue AS first WHERE first.user_id=send_queue.user_id AND first.message_id=send_queue.message_id AND first.status NOT IN ('failed','cancelled') AND first.id<send_queue.id); CREATE UNIQUE INDEX IF NOT EXISTS send_queue_message ON send_queue (user_id, message_id) WHERE message_id!='' AND status NOT IN ('failed','cancelled');`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS send_limits (user_id INTEGER NOT NULL PRIMARY KEY, per_minute INTEGER NOT NULL, jitter_min INTEGER NOT NULL default 0, jitter_max INTEGER NOT NULL default 0, recipient_interval INTEGER NOT NULL default 0, daily_cap INTEGER NOT NULL default 0);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS scheduled_messages (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, type TEXT NOT NULL, payload TEXT NOT NULL, send_at INTEGER NOT NULL, cron TEXT NOT NULL default "", status TEXT NOT NULL default "scheduled", runs INTEGER NOT NULL default 0, last_run INTEGER NOT NULL default 0, last_error TEXT NOT NULL default "", last_queue_id INTEGER NOT NULL default 0, created INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS scheduled_messages_due ON scheduled_messages (status, send_at);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	err = addColumn(db, "scheduled_messages", "late_since", "INTEGER NOT NULL default 0")
+	if err != nil {
+		return fmt.Errorf("%q: adding late_since to scheduled_messages", err)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS idempotency_keys (user_id INTEGER NOT NULL, key TEXT NOT NULL, hash TEXT NOT NULL, code INTEGER NOT NULL default 0, response BLOB, created INTEGER NOT NULL default 0, PRIMARY KEY(user_id, key)); CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys (created);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS bulk_jobs (id INTEGER NOT NULL PRIMARY KEY, user_id INTEGER NOT NULL, name TEXT NOT NULL default "", type TEXT NOT NULL, total INTEGER NOT NULL default 0, status TEXT NOT NULL default "running", created INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS bulk_jobs_user ON bulk_jobs (user_id);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+
+	sqlStmt = `CREATE TABLE IF NOT EXISTS bulk_recipients (id INTEGER NOT NULL PRIMARY KEY, job_id INTEGER NOT NULL, user_id INTEGER NOT NULL, phone TEXT NOT NULL, jid TEXT NOT NULL default "", variables TEXT NOT NULL default "", status TEXT NOT NULL, queue_id INTEGER NOT NULL default 0, message_id TEXT NOT NULL default "", error TEXT NOT NULL default "", sent INTEGER NOT NULL default 0); CREATE INDEX IF NOT EXISTS bulk_recipients_job ON bulk_recipients (job_id, status); CREATE INDEX IF NOT EXISTS bulk_recipients_message ON bulk_recipients (user_id, message_id);`
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		return fmt.Errorf("%q: %s", err, sqlStmt)
+	}
+	return nil
+}
+
+// Adds a column to an existing table unless it is already there
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		name := ""
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
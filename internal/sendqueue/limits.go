@@ -0,0 +1,53 @@
+package sendqueue
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Pacing of the messages a user sends
+type Limits struct {
+	UserId int
+	// Messages sent per minute at most
+	PerMinute int
+	// Random extra delay between two messages, in milliseconds
+	JitterMin int
+	JitterMax int
+	// Seconds to wait before messaging the same recipient again, 0 to disable
+	RecipientInterval int
+	// Messages sent per UTC day at most, 0 for no cap
+	DailyCap int
+}
+
+// Limits used by users that did not set their own, messages are not paced until they do
+var DefaultLimits = Limits{}
+
+// Gets the limits of a user, or the defaults if it has none
+func GetLimits(db *sql.DB, userid int) (*Limits, error) {
+	l := Limits{}
+	err := db.QueryRow("SELECT user_id,per_minute,jitter_min,jitter_max,recipient_interval,daily_cap FROM send_limits WHERE user_id=?", userid).Scan(&l.UserId, &l.PerMinute, &l.JitterMin, &l.JitterMax, &l.RecipientInterval, &l.DailyCap)
+	if err == sql.ErrNoRows {
+		l = DefaultLimits
+		l.UserId = userid
+		return &l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Creates or replaces the limits of a user
+func SaveLimits(db *sql.DB, l *Limits) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO send_limits (user_id,per_minute,jitter_min,jitter_max,recipient_interval,daily_cap) VALUES (?,?,?,?,?,?)", l.UserId, l.PerMinute, l.JitterMin, l.JitterMax, l.RecipientInterval, l.DailyCap)
+	return err
+}
+
+// Time to leave between two messages, jitter included
+func (l *Limits) interval() time.Duration {
+	interval := time.Duration(0)
+	if l.PerMinute > 0 {
+		interval = time.Minute / time.Duration(l.PerMinute)
+	}
+	return interval + jitter(time.Duration(l.JitterMin)*time.Millisecond, time.Duration(l.JitterMax)*time.Millisecond)
+}
@@ -0,0 +1,500 @@
+package sendqueue
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusSending   = "sending"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Returned by a Sender when the session can not send right now, the item is retried later
+var ErrNotReady = errors.New("Session not ready")
+
+// Returned by Enqueue when the message id is already used by an item that was not failed or cancelled
+var ErrDuplicate = errors.New("Message id already queued")
+
+// A message waiting to be sent, or already sent, failed or cancelled
+type Item struct {
+	Id        int64
+	UserId    int
+	Recipient string
+	MessageId string
+	Type      string
+	Status    string
+	Error     string
+	Created   int64
+	Sent      int64
+}
+
+// Sends a queued message until ctx is done, returning the time the server took it
+type Sender func(ctx context.Context, recipient types.JID, msgid string, msg *waProto.Message) (time.Time, error)
+
+// Per user queue of outbound messages, sent one at a time within the user limits
+type Queue struct {
+	Db *sql.DB
+	// Called when an item is sent, failed or cancelled, if set
+	Finished func(item *Item)
+
+	mu      sync.Mutex
+	wake    map[int]chan struct{}
+	waiters map[int64][]chan struct{}
+}
+
+func NewQueue(db *sql.DB) *Queue {
+	return &Queue{Db: db, wake: make(map[int]chan struct{}), waiters: make(map[int64][]chan struct{})}
+}
+
+func (q *Queue) wakeChan(userid int) chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch, ok := q.wake[userid]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		q.wake[userid] = ch
+	}
+	return ch
+}
+
+// Wakes the worker of a user without waiting for its next check
+func (q *Queue) notify(userid int) {
+	select {
+	case q.wakeChan(userid) <- struct{}{}:
+	default:
+	}
+}
+
+// Releases the requests waiting for an item now sent, failed or cancelled
+func (q *Queue) finish(item *Item) {
+	q.mu.Lock()
+	for _, ch := range q.waiters[item.Id] {
+		close(ch)
+	}
+	delete(q.waiters, item.Id)
+	q.mu.Unlock()
+
+	if q.Finished != nil {
+		q.Finished(item)
+	}
+}
+
+// Queues a message for a recipient, returns its queue id
+func (q *Queue) Enqueue(userid int, recipient types.JID, msgid string, msgType string, msg *waProto.Message) (int64, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	res, err := q.Db.Exec("INSERT INTO send_queue (user_id,recipient,message_id,type,message,status,created) VALUES (?,?,?,?,?,?,?) ON CONFLICT DO NOTHING", userid, recipient.String(), msgid, msgType, data, StatusPending, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return 0, ErrDuplicate
+	}
+	q.notify(userid)
+	return res.LastInsertId()
+}
+
+// Gets a queue item, returns nil if there is none
+func (q *Queue) Get(userid int, id int64) (*Item, error) {
+	item, err := scanItem(q.Db.QueryRow("SELECT "+itemColumns+" FROM send_queue WHERE user_id=? AND id=?", userid, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+// Gets the item queued with a message id, cancelled ones aside, returns nil if there is none
+func (q *Queue) FindMessage(userid int, msgid string) (*Item, error) {
+	item, err := scanItem(q.Db.QueryRow("SELECT "+itemColumns+" FROM send_queue WHERE user_id=? AND message_id=? AND status!=? ORDER BY id DESC LIMIT 1", userid, msgid, StatusCancelled))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+// Waits until an item is sent, failed or cancelled, or ctx is done
+func (q *Queue) Wait(ctx context.Context, userid int, id int64) (*Item, error) {
+	ch := make(chan struct{})
+	q.mu.Lock()
+	q.waiters[id] = append(q.waiters[id], ch)
+	q.mu.Unlock()
+	defer q.stopWaiting(id, ch)
+
+	item, err := q.Get(userid, id)
+	if err != nil || item == nil || (item.Status != StatusPending && item.Status != StatusSending) {
+		return item, err
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ch:
+	}
+	return q.Get(userid, id)
+}
+
+// Drops a waiter, finish already dropped it if the item finished
+func (q *Queue) stopWaiting(id int64, ch chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiters := q.waiters[id]
+	for i, waiter := range waiters {
+		if waiter == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(q.waiters, id)
+	} else {
+		q.waiters[id] = waiters
+	}
+}
+
+// Lists items with the given statuses, newest first, before an id if set
+func (q *Queue) List(userid int, statuses []string, before int64, limit int) ([]Item, error) {
+	where := []string{"user_id=?"}
+	args := []interface{}{userid}
+	if len(statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(",?", len(statuses)-1)+")")
+		for _, status := range statuses {
+			args = append(args, status)
+		}
+	}
+	if before > 0 {
+		where = append(where, "id<?")
+		args = append(args, before)
+	}
+	args = append(args, limit)
+
+	rows, err := q.Db.Query("SELECT "+itemColumns+" FROM send_queue WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *item)
+	}
+	return list, rows.Err()
+}
+
+// Counts the items of a user by status
+func (q *Queue) Counts(userid int) (map[string]int, error) {
+	rows, err := q.Db.Query("SELECT status, COUNT(*) FROM send_queue WHERE user_id=? GROUP BY status", userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[string]int{StatusPending: 0, StatusFailed: 0}
+	for rows.Next() {
+		status := ""
+		count := 0
+		err = rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// Counts the messages a user sent since the start of the current UTC day
+func (q *Queue) SentToday(userid int) (int, error) {
+	return q.sentSince(userid, startOfDay(time.Now()))
+}
+
+func (q *Queue) sentSince(userid int, since time.Time) (int, error) {
+	count := 0
+	err := q.Db.QueryRow("SELECT COUNT(*) FROM send_queue WHERE user_id=? AND status=? AND sent>=?", userid, StatusSent, since.Unix()).Scan(&count)
+	return count, err
+}
+
+// Cancels a pending or failed item, or every pending one if id is 0. Returns how many were cancelled.
+func (q *Queue) Cancel(userid int, id int64) (int64, error) {
+	ids := []int64{id}
+	if id == 0 {
+		rows, err := q.Db.Query("SELECT id FROM send_queue WHERE user_id=? AND status=?", userid, StatusPending)
+		if err != nil {
+			return 0, err
+		}
+		ids = ids[:0]
+		for rows.Next() {
+			err = rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+	}
+
+	cancelled := int64(0)
+	for _, id := range ids {
+		res, err := q.Db.Exec("UPDATE send_queue SET status=? WHERE user_id=? AND id=? AND status IN (?,?)", StatusCancelled, userid, id, StatusPending, StatusFailed)
+		if err != nil {
+			return cancelled, err
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			continue
+		}
+		cancelled++
+		item, err := q.Get(userid, id)
+		if err == nil && item != nil {
+			q.finish(item)
+		}
+	}
+	return cancelled, nil
+}
+
+// Fails the items being sent when the server stopped, they may or may not have gone out and
+// are never sent twice. Call it once at startup, before any session runs its queue.
+func (q *Queue) Recover() error {
+	rows, err := q.Db.Query("SELECT "+itemColumns+" FROM send_queue WHERE status=?", StatusSending)
+	if err != nil {
+		return err
+	}
+	interrupted := []*Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		interrupted = append(interrupted, item)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, item := range interrupted {
+		item.Status = StatusFailed
+		item.Error = "Interrupted while sending"
+		_, err = q.Db.Exec("UPDATE send_queue SET status=?, error=? WHERE id=?", item.Status, item.Error, item.Id)
+		if err != nil {
+			return err
+		}
+		q.finish(item)
+	}
+	return nil
+}
+
+// Sends the queued messages of a user within its limits until ctx is done
+func (q *Queue) Run(ctx context.Context, userid int, send Sender) {
+	wake := q.wakeChan(userid)
+
+	var ready time.Time
+	pruned := time.Time{}
+	for {
+		if time.Since(pruned) > time.Hour {
+			q.prune(userid)
+			pruned = time.Now()
+		}
+
+		// Pacing is not shortened by new items, only by stopping
+		if wait := time.Until(ready); wait > 0 {
+			sleep(ctx, wait)
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		wait, item, msg, limits := q.next(userid, time.Now())
+		if item == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-wake:
+				timer.Stop()
+			case <-timer.C:
+			}
+			continue
+		}
+		res, err := q.Db.Exec("UPDATE send_queue SET status=? WHERE id=? AND status=?", StatusSending, item.Id, StatusPending)
+		if err != nil {
+			log.Error().Err(err).Int64("item", item.Id).Msg("Could not update send queue")
+			sleep(ctx, time.Second)
+			continue
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			// Cancelled meanwhile
+			continue
+		}
+
+		recipient, _ := types.ParseJID(item.Recipient)
+		ts, err := send(ctx, recipient, item.MessageId, msg)
+		if err == ErrNotReady {
+			q.Db.Exec("UPDATE send_queue SET status=? WHERE id=?", StatusPending, item.Id)
+			sleep(ctx, time.Second)
+			continue
+		}
+		ready = time.Now().Add(limits.interval())
+		if err != nil {
+			log.Warn().Err(err).Int("userid", userid).Int64("item", item.Id).Msg("Queued message failed")
+			item.Status = StatusFailed
+			item.Error = err.Error()
+			if ctx.Err() != nil {
+				// Stopped by the session ending, the message may or may not have gone out
+				item.Error = "Interrupted while sending"
+			}
+		} else {
+			item.Status = StatusSent
+			item.Sent = ts.Unix()
+		}
+		_, err = q.Db.Exec("UPDATE send_queue SET status=?, error=?, sent=? WHERE id=?", item.Status, item.Error, item.Sent, item.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("item", item.Id).Msg("Could not update send queue")
+		}
+		q.finish(item)
+	}
+}
+
+// Picks the next item that can be sent at now with the limits in force. If there is none,
+// wait is how long until one might be ready.
+func (q *Queue) next(userid int, now time.Time) (time.Duration, *Item, *waProto.Message, *Limits) {
+	limits, err := GetLimits(q.Db, userid)
+	if err != nil {
+		log.Error().Err(err).Int("userid", userid).Msg("Could not read send limits")
+		return time.Minute, nil, nil, nil
+	}
+
+	if limits.DailyCap > 0 {
+		sent, err := q.sentSince(userid, startOfDay(now))
+		if err != nil {
+			log.Error().Err(err).Int("userid", userid).Msg("Could not count sent messages")
+			return time.Minute, nil, nil, nil
+		}
+		if sent >= limits.DailyCap {
+			return startOfDay(now).Add(24 * time.Hour).Sub(now), nil, nil, nil
+		}
+	}
+
+	// Items for a recipient go out in order, so only the oldest pending item of each recipient
+	// can go next. Each comes with the last time its recipient was sent a message.
+	rows, err := q.Db.Query("SELECT "+itemColumns+", (SELECT COALESCE(MAX(sent),0) FROM send_queue AS previous WHERE previous.user_id=send_queue.user_id AND previous.recipient=send_queue.recipient AND previous.status=?) FROM send_queue WHERE id IN (SELECT MIN(id) FROM send_queue WHERE user_id=? AND status=? GROUP BY recipient) ORDER BY id", StatusSent, userid, StatusPending)
+	if err != nil {
+		log.Error().Err(err).Int("userid", userid).Msg("Could not read send queue")
+		return time.Minute, nil, nil, nil
+	}
+	type candidate struct {
+		item     Item
+		lastSent int64
+	}
+	var candidates []candidate
+	for rows.Next() {
+		c := candidate{}
+		err = rows.Scan(&c.item.Id, &c.item.UserId, &c.item.Recipient, &c.item.MessageId, &c.item.Type, &c.item.Status, &c.item.Error, &c.item.Created, &c.item.Sent, &c.lastSent)
+		if err != nil {
+			break
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err != nil {
+		log.Error().Err(err).Int("userid", userid).Msg("Could not read send queue")
+		return time.Minute, nil, nil, nil
+	}
+
+	// The first item whose recipient was not messaged too recently goes next, otherwise
+	// wait for the first recipient to be ready
+	wait := time.Duration(0)
+	spacing := time.Duration(limits.RecipientInterval) * time.Second
+	for _, c := range candidates {
+		if spacing > 0 {
+			if ready := time.Unix(c.lastSent, 0).Add(spacing); ready.After(now) {
+				if wait == 0 || ready.Sub(now) < wait {
+					wait = ready.Sub(now)
+				}
+				continue
+			}
+		}
+
+		var data []byte
+		msg := &waProto.Message{}
+		err = q.Db.QueryRow("SELECT message FROM send_queue WHERE id=?", c.item.Id).Scan(&data)
+		if err == nil {
+			err = proto.Unmarshal(data, msg)
+		}
+		if err != nil {
+			c.item.Status = StatusFailed
+			c.item.Error = "Could not decode queued message"
+			q.Db.Exec("UPDATE send_queue SET status=?, error=? WHERE id=?", c.item.Status, c.item.Error, c.item.Id)
+			q.finish(&c.item)
+			continue
+		}
+		return 0, &c.item, msg, limits
+	}
+	if wait == 0 {
+		// Nothing pending, Enqueue wakes the worker
+		wait = time.Hour
+	}
+	return wait, nil, nil, nil
+}
+
+// Deletes sent and cancelled items older than two days
+func (q *Queue) prune(userid int) {
+	_, err := q.Db.Exec("DELETE FROM send_queue WHERE user_id=? AND status IN (?,?) AND created<?", userid, StatusSent, StatusCancelled, time.Now().Add(-48*time.Hour).Unix())
+	if err != nil {
+		log.Error().Err(err).Int("userid", userid).Msg("Could not prune send queue")
+	}
+}
+
+const itemColumns = "id,user_id,recipient,message_id,type,status,error,created,sent"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanItem(row scanner) (*Item, error) {
+	item := Item{}
+	err := row.Scan(&item.Id, &item.UserId, &item.Recipient, &item.MessageId, &item.Type, &item.Status, &item.Error, &item.Created, &item.Sent)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// Random duration between min and max
+func jitter(min time.Duration, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
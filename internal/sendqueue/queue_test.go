@@ -0,0 +1,191 @@
+package sendqueue
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+	"wuzapi/internal/schema"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+	_ "modernc.org/sqlite"
+)
+
+func newTestQueue(t *testing.T) *Queue {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = schema.Create(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewQueue(db)
+}
+
+// An item in the queue before picking, sent ones sentAgo before now
+type testItem struct {
+	recipient string
+	status    string
+	sentAgo   time.Duration
+	corrupt   bool
+}
+
+func pending(recipient string) testItem {
+	return testItem{recipient: recipient, status: StatusPending}
+}
+
+func sent(recipient string, ago time.Duration) testItem {
+	return testItem{recipient: recipient, status: StatusSent, sentAgo: ago}
+}
+
+func TestNext(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	data, err := proto.Marshal(&waProto.Message{Conversation: proto.String("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocked := []testItem{sent("a", 10*time.Second)}
+	for i := 0; i < 250; i++ {
+		blocked = append(blocked, pending("a"))
+	}
+	blocked = append(blocked, pending("b"))
+
+	tests := []struct {
+		name   string
+		limits *Limits
+		items  []testItem
+		// Recipient of the item picked, empty if none is ready
+		want     string
+		wantWait time.Duration
+	}{
+		{"empty queue", nil, nil, "", time.Hour},
+		{"oldest first", nil, []testItem{pending("a"), pending("b")}, "a", 0},
+		{"sent items are skipped", nil, []testItem{sent("a", time.Minute), pending("b")}, "b", 0},
+		{"no limits by default", nil, []testItem{sent("a", time.Second), pending("a")}, "a", 0},
+		{"daily cap reached", &Limits{DailyCap: 2}, []testItem{sent("a", time.Hour), sent("b", time.Hour), pending("c")}, "", 12 * time.Hour},
+		{"daily cap counts today only", &Limits{DailyCap: 2}, []testItem{sent("a", 13*time.Hour), sent("b", time.Hour), pending("c")}, "c", 0},
+		{"recipient spacing skips recent recipients", &Limits{RecipientInterval: 60}, []testItem{sent("a", 10*time.Second), pending("a"), pending("b")}, "b", 0},
+		{"recipient spacing over", &Limits{RecipientInterval: 60}, []testItem{sent("a", 2*time.Minute), pending("a"), pending("b")}, "a", 0},
+		{"waits for the first recipient ready", &Limits{RecipientInterval: 60}, []testItem{sent("a", 10*time.Second), sent("b", 30*time.Second), pending("a"), pending("b")}, "", 30 * time.Second},
+		{"waits past an hour", &Limits{RecipientInterval: 7200}, []testItem{sent("a", time.Minute), pending("a")}, "", 7200*time.Second - time.Minute},
+		{"ready item behind many spaced ones", &Limits{RecipientInterval: 60}, blocked, "b", 0},
+		{"undecodable items fail", nil, []testItem{{recipient: "a", status: StatusPending, corrupt: true}, pending("b")}, "b", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t)
+			userid := 1
+			if tt.limits != nil {
+				tt.limits.UserId = userid
+				err := SaveLimits(q.Db, tt.limits)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i, it := range tt.items {
+				message := data
+				if it.corrupt {
+					message = []byte{0xff}
+				}
+				sentAt := int64(0)
+				if it.status == StatusSent {
+					sentAt = now.Add(-it.sentAgo).Unix()
+				}
+				_, err := q.Db.Exec("INSERT INTO send_queue (user_id,recipient,message_id,type,message,status,created,sent) VALUES (?,?,?,?,?,?,?,?)", userid, it.recipient, fmt.Sprintf("TEST%08d", i), "text", message, it.status, now.Add(-time.Hour).Unix(), sentAt)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wait, item, msg, _ := q.next(userid, now)
+			if tt.want == "" {
+				if item != nil {
+					t.Fatalf("picked item %d for %s, want none", item.Id, item.Recipient)
+				}
+				if wait != tt.wantWait {
+					t.Errorf("wait %v, want %v", wait, tt.wantWait)
+				}
+				return
+			}
+			if item == nil {
+				t.Fatalf("picked no item, want one for %s (wait %v)", tt.want, wait)
+			}
+			if item.Recipient != tt.want {
+				t.Errorf("picked item for %s, want %s", item.Recipient, tt.want)
+			}
+			if msg.GetConversation() != "hello" {
+				t.Errorf("message %v", msg)
+			}
+		})
+	}
+}
+
+func TestNextFailsUndecodable(t *testing.T) {
+	q := newTestQueue(t)
+	_, err := q.Db.Exec("INSERT INTO send_queue (user_id,recipient,message_id,message) VALUES (1,'a','TEST0001',x'ff')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := []*Item{}
+	q.Finished = func(item *Item) { finished = append(finished, item) }
+
+	_, item, _, _ := q.next(1, time.Now())
+	if item != nil {
+		t.Fatalf("picked item %d", item.Id)
+	}
+	if len(finished) != 1 || finished[0].Status != StatusFailed {
+		t.Fatalf("finished %v, want the item failed", finished)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	q := newTestQueue(t)
+	for _, status := range []string{StatusPending, StatusSending, StatusSent} {
+		_, err := q.Db.Exec("INSERT INTO send_queue (user_id,recipient,message_id,message,status) VALUES (1,'a','',x'00',?)", status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := q.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := q.Counts(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{StatusPending: 1, StatusFailed: 1, StatusSent: 1}
+	for status, count := range want {
+		if counts[status] != count {
+			t.Errorf("%d %s items, want %d", counts[status], status, count)
+		}
+	}
+	if counts[StatusSending] != 0 {
+		t.Errorf("%d items still sending", counts[StatusSending])
+	}
+}
+
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		limits Limits
+		min    time.Duration
+		max    time.Duration
+	}{
+		{DefaultLimits, 0, 0},
+		{Limits{PerMinute: 20}, 3 * time.Second, 3 * time.Second},
+		{Limits{PerMinute: 60, JitterMin: 1000, JitterMax: 1000}, 2 * time.Second, 2 * time.Second},
+		{Limits{PerMinute: 60, JitterMin: 500, JitterMax: 1500}, 1500 * time.Millisecond, 2500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if got := tt.limits.interval(); got < tt.min || got > tt.max {
+				t.Errorf("%+v: interval %v, want %v to %v", tt.limits, got, tt.min, tt.max)
+			}
+		}
+	}
+}
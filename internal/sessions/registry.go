@@ -0,0 +1,176 @@
+package sessions
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Everything kept in memory for a running user session
+type Session struct {
+	UserID int
+	Client *whatsmeow.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	status Status
+	// Event types the user webhook is subscribed to
+	subscriptions []string
+}
+
+// Creates a session in connecting state, it lives until Stop is called
+func NewSession(userid int) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &Session{UserID: userid, ctx: ctx, cancel: cancel}
+	sess.SetState(StateConnecting, nil)
+	return sess
+}
+
+// Context cancelled when the session is stopped
+func (sess *Session) Context() context.Context {
+	return sess.ctx
+}
+
+// Gets the event types the user webhook is subscribed to
+func (sess *Session) Subscriptions() []string {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.subscriptions
+}
+
+// Replaces the event types the user webhook is subscribed to, from the next event on
+func (sess *Session) SetSubscriptions(events []string) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.subscriptions = events
+}
+
+// Signals the session supervisor to stop
+func (sess *Session) Stop() {
+	sess.cancel()
+}
+
+// Registry of running sessions, safe for concurrent use
+type Registry struct {
+	mu       sync.RWMutex
+	sessions map[int]*Session
+	// Last status of sessions no longer running
+	last map[int]Status
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[int]*Session), last: make(map[int]Status)}
+}
+
+// Gets the session for a user
+func (r *Registry) Get(userid int) (*Session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sess, ok := r.sessions[userid]
+	return sess, ok
+}
+
+// Gets the whatsmeow client for a user, nil if there is no session
+func (r *Registry) Client(userid int) *whatsmeow.Client {
+	sess, ok := r.Get(userid)
+	if !ok {
+		return nil
+	}
+	return sess.Client
+}
+
+// Registers a session, returns false if the user already has one running
+func (r *Registry) Register(sess *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[sess.UserID]; ok {
+		return false
+	}
+	r.sessions[sess.UserID] = sess
+	delete(r.last, sess.UserID)
+	return true
+}
+
+// Records that a session could not even be started
+func (r *Registry) Fail(userid int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last[userid] = Status{State: StateFailed, Since: time.Now(), LastError: err.Error()}
+}
+
+// Removes the session of a user, returning it if there was one
+func (r *Registry) Remove(userid int) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sess, ok := r.sessions[userid]
+	if ok {
+		delete(r.sessions, userid)
+		r.last[userid] = sess.Status()
+	}
+	return sess, ok
+}
+
+// Removes the session of a user only if it is still the given one
+func (r *Registry) RemoveIf(sess *Session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[sess.UserID] != sess {
+		return false
+	}
+	delete(r.sessions, sess.UserID)
+	r.last[sess.UserID] = sess.Status()
+	return true
+}
+
+// Forgets everything known about a user, used when the user is deleted
+func (r *Registry) Forget(userid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, userid)
+	delete(r.last, userid)
+}
+
+// Gets the status of the session of a user, or the last one seen if it is no longer running
+func (r *Registry) Status(userid int) Status {
+	r.mu.RLock()
+	sess, ok := r.sessions[userid]
+	last, seen := r.last[userid]
+	r.mu.RUnlock()
+	if ok {
+		return sess.Status()
+	}
+	if seen {
+		return last
+	}
+	return Status{State: StateDisconnected}
+}
+
+// Signals the session of a user to stop, returns false if there was none
+func (r *Registry) Kill(userid int) bool {
+	sess, ok := r.Get(userid)
+	if !ok {
+		return false
+	}
+	sess.Stop()
+	return true
+}
+
+// Calls fn for every registered session until it returns false
+func (r *Registry) Range(fn func(userid int, sess *Session) bool) {
+	r.mu.RLock()
+	snapshot := make([]*Session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		snapshot = append(snapshot, sess)
+	}
+	r.mu.RUnlock()
+
+	for _, sess := range snapshot {
+		if !fn(sess.UserID, sess) {
+			return
+		}
+	}
+}
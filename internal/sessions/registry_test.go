@@ -0,0 +1,182 @@
+package sessions
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, r *Registry)
+	}{
+		{"register twice", func(t *testing.T, r *Registry) {
+			if !r.Register(NewSession(1)) {
+				t.Fatal("first register failed")
+			}
+			if r.Register(NewSession(1)) {
+				t.Fatal("second register succeeded")
+			}
+		}},
+		{"kill stops the session", func(t *testing.T, r *Registry) {
+			sess := NewSession(1)
+			r.Register(sess)
+			if !r.Kill(1) {
+				t.Fatal("kill found no session")
+			}
+			if sess.Context().Err() == nil {
+				t.Fatal("session context not cancelled")
+			}
+			if r.Kill(2) {
+				t.Fatal("kill found a session for an unknown user")
+			}
+		}},
+		{"remove keeps the last status", func(t *testing.T, r *Registry) {
+			sess := NewSession(1)
+			r.Register(sess)
+			sess.SetState(StateConnected, nil)
+			if _, ok := r.Remove(1); !ok {
+				t.Fatal("remove found no session")
+			}
+			if r.Client(1) != nil {
+				t.Fatal("client still registered")
+			}
+			if state := r.Status(1).State; state != StateConnected {
+				t.Fatalf("last state %q, want %q", state, StateConnected)
+			}
+		}},
+		{"remove if ignores replaced sessions", func(t *testing.T, r *Registry) {
+			old := NewSession(1)
+			r.Register(old)
+			r.Remove(1)
+			current := NewSession(1)
+			r.Register(current)
+			if r.RemoveIf(old) {
+				t.Fatal("removed a replaced session")
+			}
+			if sess, _ := r.Get(1); sess != current {
+				t.Fatal("current session was removed")
+			}
+		}},
+		{"subscriptions follow updates", func(t *testing.T, r *Registry) {
+			r.Register(NewSession(1))
+			sess, _ := r.Get(1)
+			sess.SetSubscriptions([]string{"Message"})
+			sess.SetSubscriptions([]string{"Message", "ReadReceipt"})
+			if got, _ := r.Get(1); len(got.Subscriptions()) != 2 {
+				t.Fatalf("subscriptions %v after update", got.Subscriptions())
+			}
+		}},
+		{"fail and forget", func(t *testing.T, r *Registry) {
+			r.Fail(1, errors.New("no device"))
+			status := r.Status(1)
+			if status.State != StateFailed || status.LastError != "no device" {
+				t.Fatalf("status %+v after fail", status)
+			}
+			r.Forget(1)
+			if state := r.Status(1).State; state != StateDisconnected {
+				t.Fatalf("state %q after forget, want %q", state, StateDisconnected)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, NewRegistry())
+		})
+	}
+}
+
+// Hammers the registry from parallel goroutines, run with -race to catch unsynchronized access
+func TestRegistryConcurrent(t *testing.T) {
+	ops := map[string]func(r *Registry, userid int){
+		"register": func(r *Registry, userid int) { r.Register(NewSession(userid)) },
+		"fail":     func(r *Registry, userid int) { r.Fail(userid, errors.New("failed")) },
+		"remove":   func(r *Registry, userid int) { r.Remove(userid) },
+		"remove if": func(r *Registry, userid int) {
+			if sess, ok := r.Get(userid); ok {
+				r.RemoveIf(sess)
+			}
+		},
+		"kill":   func(r *Registry, userid int) { r.Kill(userid) },
+		"client": func(r *Registry, userid int) { r.Client(userid) },
+		"status": func(r *Registry, userid int) { r.Status(userid) },
+		"state": func(r *Registry, userid int) {
+			if sess, ok := r.Get(userid); ok {
+				sess.Failed(errors.New("failed"))
+				sess.SetState(StateConnected, nil)
+			}
+		},
+		"range": func(r *Registry, userid int) {
+			r.Range(func(id int, sess *Session) bool { return sess.Status().State != "" })
+		},
+	}
+	names := []string{}
+	for name := range ops {
+		names = append(names, name)
+	}
+
+	tests := []struct {
+		name    string
+		users   int
+		workers int
+		rounds  int
+		ops     []string
+	}{
+		{"register and remove", 4, 16, 500, []string{"register", "remove", "remove if", "client"}},
+		{"register and kill", 4, 16, 500, []string{"register", "kill", "remove if", "status"}},
+		{"failures", 2, 8, 500, []string{"register", "fail", "remove", "status", "state"}},
+		{"everything", 8, 32, 500, names},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			var wg sync.WaitGroup
+			for worker := 0; worker < tt.workers; worker++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					random := rand.New(rand.NewSource(seed))
+					for i := 0; i < tt.rounds; i++ {
+						ops[tt.ops[random.Intn(len(tt.ops))]](r, 1+random.Intn(tt.users))
+					}
+				}(int64(worker))
+			}
+			wg.Wait()
+
+			r.Range(func(userid int, sess *Session) bool {
+				if sess.UserID != userid {
+					t.Errorf("session of user %d registered for user %d", sess.UserID, userid)
+				}
+				if got, _ := r.Get(userid); got != sess {
+					t.Errorf("user %d has two sessions", userid)
+				}
+				return true
+			})
+		})
+	}
+}
+
+// Only one of many sessions registered at once for the same user wins
+func TestRegistryConcurrentRegister(t *testing.T) {
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.Register(NewSession(1)) {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Fatalf("%d sessions registered, want 1", won)
+	}
+}
@@ -0,0 +1,55 @@
+package sessions
+
+import "time"
+
+// Session states reported by the supervisor
+const (
+	StatePairing      = "pairing"
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateLoggedOut    = "logged_out"
+	StateFailed       = "failed"
+)
+
+// Snapshot of the state of a session
+type Status struct {
+	State     string
+	Since     time.Time
+	LastError string
+	// Failed connection attempts since the last successful one
+	Attempts int
+}
+
+// Gets a snapshot of the session state
+func (sess *Session) Status() Status {
+	sess.mu.RLock()
+	defer sess.mu.RUnlock()
+	return sess.status
+}
+
+// Records a state transition, err is kept as the last error if not nil
+func (sess *Session) SetState(state string, err error) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.status.State != state {
+		sess.status.State = state
+		sess.status.Since = time.Now()
+	}
+	if err != nil {
+		sess.status.LastError = err.Error()
+	}
+	if state == StateConnected {
+		sess.status.Attempts = 0
+		sess.status.LastError = ""
+	}
+}
+
+// Records a failed connection attempt, returns how many failed in a row
+func (sess *Session) Failed(err error) int {
+	sess.SetState(StateDisconnected, err)
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.status.Attempts++
+	return sess.status.Attempts
+}
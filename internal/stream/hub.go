@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// An event envelope as sent to stream clients
+type Event struct {
+	Id   uint64
+	Type string
+	Data []byte
+}
+
+// A client listening to the events of a user
+type Subscription struct {
+	UserID int
+	Types  []string
+	// Closed by the hub when the client falls too far behind
+	C chan Event
+
+	closed bool
+}
+
+func (sub *Subscription) wants(eventType string) bool {
+	if len(sub.Types) == 0 {
+		return true
+	}
+	for _, t := range sub.Types {
+		if t == eventType || t == "All" {
+			return true
+		}
+	}
+	return false
+}
+
+// Fans events out to stream clients and keeps the last ones of every user
+// in a ring buffer so clients can resume after a reconnect.
+type Hub struct {
+	mu      sync.Mutex
+	size    int
+	startId uint64
+	lastId  uint64
+	rings   map[int][]Event
+	// Id of the newest event pushed out of the ring of each user
+	dropped map[int]uint64
+	subs    map[int]map[*Subscription]bool
+}
+
+// Creates a hub keeping up to size events per user. Ids start from the current
+// time so they keep growing across restarts.
+func NewHub(size int) *Hub {
+	if size < 1 {
+		size = 1
+	}
+	start := uint64(time.Now().UnixNano() / int64(time.Millisecond) * 1000)
+	return &Hub{
+		size:    size,
+		startId: start,
+		lastId:  start,
+		rings:   make(map[int][]Event),
+		dropped: make(map[int]uint64),
+		subs:    make(map[int]map[*Subscription]bool),
+	}
+}
+
+// Assigns the next id to an event envelope, buffers it and sends it to the
+// subscribers of the user. The id is added to the envelope as "id".
+func (h *Hub) Publish(userid int, eventType string, envelope map[string]interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastId++
+	withId := make(map[string]interface{}, len(envelope)+1)
+	for k, v := range envelope {
+		withId[k] = v
+	}
+	withId["id"] = h.lastId
+	data, err := json.Marshal(withId)
+	if err != nil {
+		return
+	}
+	evt := Event{Id: h.lastId, Type: eventType, Data: data}
+
+	ring := append(h.rings[userid], evt)
+	if len(ring) > h.size {
+		h.dropped[userid] = ring[len(ring)-h.size-1].Id
+		ring = ring[len(ring)-h.size:]
+	}
+	h.rings[userid] = ring
+
+	for sub := range h.subs[userid] {
+		if !sub.wants(eventType) {
+			continue
+		}
+		select {
+		case sub.C <- evt:
+		default:
+			// Slow client, drop it so it reconnects and resumes from its last id
+			h.remove(sub)
+		}
+	}
+}
+
+// Registers a client for the events of a user of the given types (all if empty).
+// Buffered events after the given id are returned to be sent first, gap is true
+// if some events after it are no longer buffered.
+func (h *Hub) Subscribe(userid int, types []string, after uint64) (sub *Subscription, backlog []Event, gap bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub = &Subscription{UserID: userid, Types: types, C: make(chan Event, 64)}
+	if h.subs[userid] == nil {
+		h.subs[userid] = make(map[*Subscription]bool)
+	}
+	h.subs[userid][sub] = true
+
+	if after == 0 {
+		return sub, nil, false
+	}
+	// Events from before a restart or pushed out of the ring are lost
+	gap = after < h.startId || after < h.dropped[userid]
+	for _, evt := range h.rings[userid] {
+		if evt.Id > after && sub.wants(evt.Type) {
+			backlog = append(backlog, evt)
+		}
+	}
+	return sub, backlog, gap
+}
+
+// Stops sending events to a client
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+func (h *Hub) remove(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	close(sub.C)
+	delete(h.subs[sub.UserID], sub)
+	if len(h.subs[sub.UserID]) == 0 {
+		delete(h.subs, sub.UserID)
+	}
+}
+
+// Drops the buffered events of a user and disconnects its clients
+func (h *Hub) Forget(userid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[userid] {
+		h.remove(sub)
+	}
+	delete(h.rings, userid)
+	delete(h.dropped, userid)
+}
@@ -1,3 +1,3 @@
 package internalTypes
 
-var MessageTypes []string = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+var MessageTypes []string = []string{"Message", "MessageRevoked", "MessageEdited", "PollVote", "GroupParticipantsChanged", "GroupInfoChanged", "JoinedGroup", "GroupJoinRequest", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "Connected", "Disconnected", "LoggedOut", "All"}
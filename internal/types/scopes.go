@@ -0,0 +1,12 @@
+package internalTypes
+
+const (
+	ScopeAll        = "*"
+	ScopeSession    = "session"
+	ScopeSend       = "send"
+	ScopeRead       = "read"
+	ScopeGroupAdmin = "group:admin"
+	ScopeWebhook    = "webhook"
+)
+
+var Scopes []string = []string{ScopeSession, ScopeSend, ScopeRead, ScopeGroupAdmin, ScopeWebhook, ScopeAll}
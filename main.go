@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -11,9 +12,17 @@ import (
 	"path/filepath"
 	"syscall"
 	"time"
+	"wuzapi/internal/bulk"
 	"wuzapi/internal/controller"
+	"wuzapi/internal/idempotency"
+	"wuzapi/internal/outbound"
+	"wuzapi/internal/scheduler"
+	"wuzapi/internal/schema"
+	"wuzapi/internal/sendqueue"
+	"wuzapi/internal/sessions"
+	"wuzapi/internal/stream"
+	"wuzapi/webhook"
 
-	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	waLog "go.mau.fi/whatsmeow/util/log"
 
@@ -31,9 +40,14 @@ var (
 	logType    = flag.String("logtype", "console", "Type of log output (console or json)")
 	sslcert    = flag.String("sslcertificate", "", "SSL Certificate File")
 	sslprivkey = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	adminToken = flag.String("admintoken", "", "Token for the admin API (disabled if empty)")
+	whWorkers  = flag.Int("webhookworkers", 4, "Number of concurrent webhook deliveries")
+	whAttempts = flag.Int("webhookattempts", 10, "Webhook delivery attempts before dead lettering")
+	publicUrl  = flag.String("publicurl", "", "Public base URL of this server, used for signed media links in webhooks")
+	mediaTTL   = flag.Duration("mediattl", 7*24*time.Hour, "Validity of signed media links")
+	evBuffer   = flag.Int("eventbuffer", 1000, "Events kept per user for event stream clients to resume from")
 	container  *sqlstore.Container
 
-	killchannel   = make(map[int](chan bool))
 	userinfocache = cache.New(5*time.Minute, 10*time.Minute)
 	log           zerolog.Logger
 )
@@ -67,17 +81,27 @@ func main() {
 		}
 	}
 
-	db, err := sql.Open("sqlite", exPath+"/dbdata/users.db")
+	// Webhook workers, sessions and API requests write concurrently, wait for locks instead of failing
+	db, err := sql.Open("sqlite", exPath+"/dbdata/users.db?_pragma=busy_timeout(5000)")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not open/create " + exPath + "/dbdata/users.db")
 		os.Exit(1)
 	}
 	defer db.Close()
 
-	sqlStmt := `CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, token TEXT NOT NULL, webhook TEXT NOT NULL default "", jid TEXT NOT NULL default "", qrcode TEXT NOT NULL default "", connected INTEGER, expiration INTEGER, events TEXT NOT NULL default "All");`
-	_, err = db.Exec(sqlStmt)
+	err = schema.Create(db)
 	if err != nil {
-		panic(fmt.Sprintf("%q: %s\n", err, sqlStmt))
+		panic(err)
+	}
+
+	mediaKey, err := webhook.MediaKey(db)
+	if err != nil {
+		panic(fmt.Sprintf("%q: reading media signing key\n", err))
+	}
+
+	err = idempotency.ReleaseUnfinished(db)
+	if err != nil {
+		panic(fmt.Sprintf("%q: releasing idempotency keys\n", err))
 	}
 
 	if *waDebug != "" {
@@ -90,22 +114,62 @@ func main() {
 		panic(err)
 	}
 
+	httpClient := resty.New()
+	httpClient.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+	httpClient.SetTimeout(30 * time.Second)
+	httpClient.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	httpClient.SetDebug(*waDebug == "DEBUG")
+
 	s := &controller.Server{
 		Router:        mux.NewRouter(),
 		Db:            db,
 		ExPath:        exPath,
-		ClientPointer: make(map[int]*whatsmeow.Client),
-		KillChannel:   killchannel,
+		Sessions:      sessions.NewRegistry(),
 		UserInfoCache: userinfocache,
 		Container:     container,
 		WaDebug:       waDebug,
-		ClientHttp:    make(map[int]*resty.Client),
 		LogType:       logType,
+		AdminToken:    adminToken,
+		Outbox:        webhook.NewOutbox(db, httpClient, *whWorkers, *whAttempts),
+		Stream:        stream.NewHub(*evBuffer),
+		Consumers:     outbound.NewManager(db),
+		SendQueue:     sendqueue.NewQueue(db),
+		Scheduler:     scheduler.NewScheduler(db),
+		SendHandlers:  make(map[string]http.HandlerFunc),
+		Media:         &webhook.MediaSigner{Key: mediaKey, BaseUrl: *publicUrl, TTL: *mediaTTL},
 	}
 
+	// Bulk jobs follow their messages through the send queue
+	s.SendQueue.Finished = func(item *sendqueue.Item) {
+		err := bulk.Finished(db, item)
+		if err != nil {
+			log.Error().Err(err).Int64("item", item.Id).Msg("Could not update bulk recipient")
+		}
+	}
+
+	err = s.SendQueue.Recover()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not recover send queue")
+	}
+
+	err = s.MigrateLegacyTokens()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not migrate plaintext tokens")
+	}
+
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	defer stopOutbox()
+	go s.Outbox.Run(outboxCtx)
+
 	setupRoutes(s)
 
+	// Scheduled messages go through the send handlers registered with the routes
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+	go s.Scheduler.Run(schedulerCtx, s.FireScheduled)
+
 	s.ConnectOnStartup()
+	go s.SweepExpiredUsers(time.Minute)
 
 	srv := &http.Server{
 		Addr:    *address + ":" + *port,
@@ -5,8 +5,11 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+	"wuzapi/controllers/admin"
 	"wuzapi/controllers/chat"
+	"wuzapi/controllers/events"
 	"wuzapi/controllers/group"
+	"wuzapi/controllers/media"
 	"wuzapi/controllers/session"
 	"wuzapi/controllers/user"
 	"wuzapi/controllers/webhook"
@@ -69,8 +72,54 @@ func setupRoutes(s *controller.Server) {
 	chatMessageController := &chat.ChatMessageController{Server: s}
 	chatMessageController.SignRoutes(c)
 
+	chatConsumerController := &chat.ChatConsumerController{Server: s}
+	chatConsumerController.SignRoutes(c)
+
+	chatQueueController := &chat.ChatQueueController{Server: s}
+	chatQueueController.SignRoutes(c)
+
+	chatScheduledController := &chat.ChatScheduledController{Server: s}
+	chatScheduledController.SignRoutes(c)
+
+	chatBulkController := &chat.ChatBulkController{Server: s}
+	chatBulkController.SignRoutes(c)
+
 	groupController := &group.GroupController{Server: s}
 	groupController.SignRoutes(c)
 
+	eventsController := &events.EventsController{Server: s}
+	eventsController.SignRoutes(c)
+
+	a := alice.New()
+	a = a.Append(s.AdminAuth)
+	a = a.Append(hlog.NewHandler(log))
+
+	a = a.Append(hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		hlog.FromRequest(r).Info().
+			Str("method", r.Method).
+			Stringer("url", r.URL).
+			Int("status", status).
+			Int("size", size).
+			Dur("duration", duration).
+			Msg("Got Admin API Request")
+	}))
+	a = a.Append(hlog.RemoteAddrHandler("ip"))
+	a = a.Append(hlog.UserAgentHandler("user_agent"))
+	a = a.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
+
+	adminController := &admin.AdminController{Server: s}
+	adminController.SignRoutes(a)
+
+	adminWebhookController := &admin.AdminWebhookController{Server: s}
+	adminWebhookController.SignRoutes(a)
+
+	m := alice.New()
+	m = m.Append(hlog.NewHandler(log))
+	m = m.Append(hlog.RemoteAddrHandler("ip"))
+	m = m.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
+
+	mediaController := &media.MediaController{Server: s}
+	mediaController.SignRoutes(m)
+
 	s.Router.PathPrefix("/").Handler(http.FileServer(http.Dir(exPath + "/static/")))
 }
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Publishes deliveries to an AMQP 0-9-1 exchange with the subject as routing key.
+// The exchange is set with the exchange query parameter of the URL, amq.topic by default.
+type AmqpSink struct {
+	conn     *amqp.Connection
+	exchange string
+
+	// Channels are not safe for concurrent publishing with confirms
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+func dialAmqp(u *url.URL) (*AmqpSink, error) {
+	query := u.Query()
+	exchange := query.Get("exchange")
+	if exchange == "" {
+		exchange = "amq.topic"
+	}
+	query.Del("exchange")
+	dial := *u
+	dial.RawQuery = query.Encode()
+
+	conn, err := amqp.Dial(dial.String())
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = channel.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &AmqpSink{conn: conn, exchange: exchange, channel: channel}, nil
+}
+
+// Publishes the delivery body as a persistent message and waits for the broker to confirm it
+func (a *AmqpSink) Deliver(d *Delivery) error {
+	headers := amqp.Table{}
+	for name, value := range d.Headers {
+		headers[name] = value
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	confirm, err := a.channel.PublishWithDeferredConfirmWithContext(ctx, a.exchange, d.Subject, false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Headers:      headers,
+		Body:         []byte(d.Body),
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("Message rejected by broker")
+	}
+	return nil
+}
+
+func (a *AmqpSink) Close() {
+	a.conn.Close()
+}
@@ -0,0 +1,301 @@
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// A message published to the AMQP stand-in
+type amqpMessage struct {
+	Exchange     string
+	RoutingKey   string
+	ContentType  string
+	DeliveryMode uint8
+	Headers      map[string]string
+	Body         string
+}
+
+// Stand-in AMQP 0-9-1 broker speaking enough of the protocol to open a channel in
+// confirm mode and take publishes, acknowledging each one
+type amqpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []amqpMessage
+}
+
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+)
+
+type amqpFrame struct {
+	kind    byte
+	channel uint16
+	payload []byte
+}
+
+func newAmqpServer(t *testing.T) *amqpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &amqpServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				err := server.serve(conn)
+				if err != nil && err != io.EOF {
+					t.Errorf("AMQP stand-in: %v", err)
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (a *amqpServer) Url(query string) string {
+	return "amqp://guest:guest@" + a.listener.Addr().String() + "/" + query
+}
+
+func (a *amqpServer) Messages() []amqpMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]amqpMessage{}, a.messages...)
+}
+
+func (a *amqpServer) serve(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return err
+	}
+	if string(header) != "AMQP\x00\x00\x09\x01" {
+		return fmt.Errorf("protocol header %q", header)
+	}
+
+	// connection.start with no server properties, PLAIN auth and en_US locale
+	start := []byte{0, 9}
+	start = append(start, 0, 0, 0, 0)
+	start = appendLongString(start, "PLAIN")
+	start = appendLongString(start, "en_US")
+	err = writeMethod(conn, 0, 10, 10, start)
+	if err != nil {
+		return err
+	}
+
+	var publish *amqpMessage
+	var bodySize uint64
+	tag := uint64(0)
+	for {
+		frame, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		switch frame.kind {
+		case amqpFrameHeartbeat:
+			continue
+		case amqpFrameHeader:
+			if publish == nil {
+				return fmt.Errorf("content header without basic.publish")
+			}
+			bodySize, err = parseContentHeader(frame.payload, publish)
+			if err != nil {
+				return err
+			}
+		case amqpFrameBody:
+			if publish == nil {
+				return fmt.Errorf("content body without basic.publish")
+			}
+			publish.Body += string(frame.payload)
+		case amqpFrameMethod:
+			class := binary.BigEndian.Uint16(frame.payload[0:2])
+			method := binary.BigEndian.Uint16(frame.payload[2:4])
+			args := frame.payload[4:]
+			switch {
+			case class == 10 && method == 11: // connection.start-ok
+				// connection.tune: no channel limit, 128 KB frames, no heartbeats
+				err = writeMethod(conn, 0, 10, 30, []byte{0, 0, 0, 2, 0, 0, 0, 0})
+			case class == 10 && method == 31: // connection.tune-ok
+			case class == 10 && method == 40: // connection.open
+				err = writeMethod(conn, 0, 10, 41, []byte{0})
+			case class == 10 && method == 50: // connection.close
+				writeMethod(conn, 0, 10, 51, nil)
+				return io.EOF
+			case class == 20 && method == 10: // channel.open
+				err = writeMethod(conn, frame.channel, 20, 11, []byte{0, 0, 0, 0})
+			case class == 20 && method == 40: // channel.close
+				err = writeMethod(conn, frame.channel, 20, 41, nil)
+			case class == 85 && method == 10: // confirm.select
+				err = writeMethod(conn, frame.channel, 85, 11, nil)
+			case class == 60 && method == 40: // basic.publish
+				publish = &amqpMessage{Headers: map[string]string{}}
+				rest := args[2:]
+				publish.Exchange, rest = readShortString(rest)
+				publish.RoutingKey, _ = readShortString(rest)
+			default:
+				return fmt.Errorf("unexpected method %d.%d", class, method)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if publish != nil && bodySize > 0 && uint64(len(publish.Body)) >= bodySize {
+			a.mu.Lock()
+			a.messages = append(a.messages, *publish)
+			a.mu.Unlock()
+			publish = nil
+			bodySize = 0
+			// basic.ack for the publish, delivery tags count from 1 per channel
+			tag++
+			var ack bytes.Buffer
+			binary.Write(&ack, binary.BigEndian, tag)
+			ack.WriteByte(0)
+			err = writeMethod(conn, frame.channel, 60, 80, ack.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func readFrame(reader *bufio.Reader) (*amqpFrame, error) {
+	header := make([]byte, 7)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	frame := &amqpFrame{kind: header[0], channel: binary.BigEndian.Uint16(header[1:3])}
+	frame.payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	_, err = io.ReadFull(reader, frame.payload)
+	if err != nil {
+		return nil, err
+	}
+	if frame.payload[len(frame.payload)-1] != amqpFrameEnd {
+		return nil, fmt.Errorf("frame without end marker")
+	}
+	frame.payload = frame.payload[:len(frame.payload)-1]
+	return frame, nil
+}
+
+func writeMethod(w io.Writer, channel uint16, class uint16, method uint16, args []byte) error {
+	var frame bytes.Buffer
+	frame.WriteByte(amqpFrameMethod)
+	binary.Write(&frame, binary.BigEndian, channel)
+	binary.Write(&frame, binary.BigEndian, uint32(4+len(args)))
+	binary.Write(&frame, binary.BigEndian, class)
+	binary.Write(&frame, binary.BigEndian, method)
+	frame.Write(args)
+	frame.WriteByte(amqpFrameEnd)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+func appendLongString(b []byte, s string) []byte {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(s)))
+	return append(append(b, size...), s...)
+}
+
+func readShortString(b []byte) (string, []byte) {
+	size := int(b[0])
+	return string(b[1 : 1+size]), b[1+size:]
+}
+
+// Reads the body size and the content type, headers and delivery mode properties of a publish
+func parseContentHeader(payload []byte, msg *amqpMessage) (uint64, error) {
+	bodySize := binary.BigEndian.Uint64(payload[4:12])
+	flags := binary.BigEndian.Uint16(payload[12:14])
+	rest := payload[14:]
+	if flags&0x8000 != 0 {
+		msg.ContentType, rest = readShortString(rest)
+	}
+	if flags&0x4000 != 0 {
+		_, rest = readShortString(rest)
+	}
+	if flags&0x2000 != 0 {
+		size := binary.BigEndian.Uint32(rest[0:4])
+		table := bytes.NewReader(rest[4 : 4+size])
+		rest = rest[4+size:]
+		for table.Len() > 0 {
+			nameSize, _ := table.ReadByte()
+			name := make([]byte, nameSize)
+			io.ReadFull(table, name)
+			kind, _ := table.ReadByte()
+			if kind != 'S' {
+				return 0, fmt.Errorf("header %s has type %c, want S", name, kind)
+			}
+			var valueSize uint32
+			binary.Read(table, binary.BigEndian, &valueSize)
+			value := make([]byte, valueSize)
+			io.ReadFull(table, value)
+			msg.Headers[string(name)] = string(value)
+		}
+	}
+	if flags&0x1000 != 0 {
+		msg.DeliveryMode = rest[0]
+	}
+	return bodySize, nil
+}
+
+func TestAmqpSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		template string
+		types    []string
+		exchange string
+		want     []string
+	}{
+		{"default exchange and subject", "", "", []string{"Message"}, "amq.topic", []string{"wuzapi.7.Message"}},
+		{"custom exchange and subject", "?exchange=whatsapp", "events.{type}.{userid}", []string{"Message", "ReadReceipt"}, "whatsapp", []string{"events.Message.7", "events.ReadReceipt.7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newAmqpServer(t)
+			deliverAll(t, server.Url(tt.query), tt.template, tt.types...)
+
+			// Deliver waits for the broker confirmation, so everything published has been taken
+			messages := server.Messages()
+			if len(messages) != len(tt.want) {
+				t.Fatalf("%d messages published, want %d", len(messages), len(tt.want))
+			}
+			for i, msg := range messages {
+				if msg.Exchange != tt.exchange {
+					t.Errorf("exchange %q, want %q", msg.Exchange, tt.exchange)
+				}
+				if msg.RoutingKey != tt.want[i] {
+					t.Errorf("routing key %q, want %q", msg.RoutingKey, tt.want[i])
+				}
+				if want := `{"type":"` + tt.types[i] + `"}`; msg.Body != want {
+					t.Errorf("body %q, want %q", msg.Body, want)
+				}
+				if msg.ContentType != "application/json" {
+					t.Errorf("content type %q", msg.ContentType)
+				}
+				if msg.DeliveryMode != 2 {
+					t.Errorf("delivery mode %d, want persistent", msg.DeliveryMode)
+				}
+				if msg.Headers["X-Source"] != "wuzapi" {
+					t.Errorf("headers %v", msg.Headers)
+				}
+			}
+		})
+	}
+}
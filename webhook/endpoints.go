@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A webhook endpoint of a user, called for the events and chats it is filtered on
+type Endpoint struct {
+	Id     int64
+	UserId int
+	Url    string
+	// Event types delivered, All for every type
+	Events []string
+	// Chat JIDs delivered, empty for every chat
+	Chats   []string
+	Enabled bool
+	Headers map[string]string
+	// Delivery format and media mode
+	Format string
+	Media  string
+	// Subject template for broker URLs
+	Subject string
+	Created int64
+}
+
+// Checks if an event of eventType in chat should be delivered to the endpoint.
+// Events not related to a chat only pass endpoints without chat filters.
+func (e *Endpoint) Matches(eventType string, chat string) bool {
+	if !e.Enabled {
+		return false
+	}
+	typeMatch := false
+	for _, item := range e.Events {
+		if item == eventType || item == "All" {
+			typeMatch = true
+			break
+		}
+	}
+	if !typeMatch {
+		return false
+	}
+	if len(e.Chats) == 0 {
+		return true
+	}
+	for _, item := range e.Chats {
+		if item == chat {
+			return true
+		}
+	}
+	return false
+}
+
+const endpointColumns = "id,user_id,url,events,chats,enabled,headers,format,media,subject,created"
+
+func scanEndpoint(row scanner) (*Endpoint, error) {
+	e := Endpoint{}
+	events := ""
+	chats := ""
+	headers := ""
+	err := row.Scan(&e.Id, &e.UserId, &e.Url, &events, &chats, &e.Enabled, &headers, &e.Format, &e.Media, &e.Subject, &e.Created)
+	if err != nil {
+		return nil, err
+	}
+	e.Events = splitList(events)
+	e.Chats = splitList(chats)
+	e.Headers = map[string]string{}
+	if headers != "" {
+		err = json.Unmarshal([]byte(headers), &e.Headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+// Lists the webhook endpoints of a user
+func ListEndpoints(db *sql.DB, userid int) ([]Endpoint, error) {
+	rows, err := db.Query("SELECT "+endpointColumns+" FROM webhooks WHERE user_id=? ORDER BY id", userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Endpoint{}
+	for rows.Next() {
+		e, err := scanEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *e)
+	}
+	return list, rows.Err()
+}
+
+// Gets a webhook endpoint of a user, returns nil if there is none
+func GetEndpoint(db *sql.DB, userid int, id int64) (*Endpoint, error) {
+	e, err := scanEndpoint(db.QueryRow("SELECT "+endpointColumns+" FROM webhooks WHERE user_id=? AND id=?", userid, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// Lists the endpoints of a user an event of eventType in chat should be delivered to
+func MatchingEndpoints(db *sql.DB, userid int, eventType string, chat string) ([]Endpoint, error) {
+	list, err := ListEndpoints(db, userid)
+	if err != nil {
+		return nil, err
+	}
+	matching := []Endpoint{}
+	for _, e := range list {
+		if e.Matches(eventType, chat) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, nil
+}
+
+// Stores a new webhook endpoint, setting its id and creation time
+func CreateEndpoint(db *sql.DB, e *Endpoint) error {
+	headers, err := json.Marshal(e.Headers)
+	if err != nil {
+		return err
+	}
+	e.Created = time.Now().Unix()
+	res, err := db.Exec("INSERT INTO webhooks (user_id,url,events,chats,enabled,headers,format,media,subject,created) VALUES (?,?,?,?,?,?,?,?,?,?)", e.UserId, e.Url, strings.Join(e.Events, ","), strings.Join(e.Chats, ","), e.Enabled, string(headers), e.Format, e.Media, e.Subject, e.Created)
+	if err != nil {
+		return err
+	}
+	e.Id, err = res.LastInsertId()
+	return err
+}
+
+// Saves changes to a webhook endpoint, returns false if it does not exist
+func UpdateEndpoint(db *sql.DB, e *Endpoint) (bool, error) {
+	headers, err := json.Marshal(e.Headers)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec("UPDATE webhooks SET url=?, events=?, chats=?, enabled=?, headers=?, format=?, media=?, subject=? WHERE user_id=? AND id=?", e.Url, strings.Join(e.Events, ","), strings.Join(e.Chats, ","), e.Enabled, string(headers), e.Format, e.Media, e.Subject, e.UserId, e.Id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Deletes a webhook endpoint of a user, returns false if it does not exist
+func DeleteEndpoint(db *sql.DB, userid int, id int64) (bool, error) {
+	res, err := db.Exec("DELETE FROM webhooks WHERE user_id=? AND id=?", userid, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
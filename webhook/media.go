@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Builds and checks signed links to media saved for a user
+type MediaSigner struct {
+	Key []byte
+	// Public base URL of this server, links can not be built without it
+	BaseUrl string
+	TTL     time.Duration
+}
+
+func (m *MediaSigner) sign(userid int, name string, expires string) string {
+	mac := hmac.New(sha256.New, m.Key)
+	mac.Write([]byte(fmt.Sprintf("%d/%s.%s", userid, name, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Builds a link to a saved media file valid for TTL, empty if there is no base URL
+func (m *MediaSigner) URL(userid int, name string) string {
+	if m.BaseUrl == "" {
+		return ""
+	}
+	expires := strconv.FormatInt(time.Now().Add(m.TTL).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", m.sign(userid, name, expires))
+	return fmt.Sprintf("%s/media/%d/%s?%s", strings.TrimRight(m.BaseUrl, "/"), userid, url.PathEscape(name), query.Encode())
+}
+
+// Checks a link signature and that it has not expired
+func (m *MediaSigner) Verify(userid int, name string, expires string, signature string) bool {
+	until, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > until {
+		return false
+	}
+	return hmac.Equal([]byte(m.sign(userid, name, expires)), []byte(signature))
+}
+
+// Gets the key media links are signed with, creating it on first use so links survive restarts
+func MediaKey(db *sql.DB) ([]byte, error) {
+	value := ""
+	err := db.QueryRow("SELECT value FROM settings WHERE name='media_key'").Scan(&value)
+	if err == nil {
+		return hex.DecodeString(value)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO settings (name,value) VALUES ('media_key',?)", hex.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow("SELECT value FROM settings WHERE name='media_key'").Scan(&value)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(value)
+}
@@ -0,0 +1,38 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Publishes deliveries to a NATS subject
+type NatsSink struct {
+	conn *nats.Conn
+}
+
+func dialNats(rawurl string) (*NatsSink, error) {
+	conn, err := nats.Connect(rawurl, nats.Name("wuzapi"), nats.Timeout(10*time.Second), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NatsSink{conn: conn}, nil
+}
+
+// Publishes the delivery body to its subject and waits for the server to take it
+func (n *NatsSink) Deliver(d *Delivery) error {
+	msg := nats.NewMsg(d.Subject)
+	msg.Data = []byte(d.Body)
+	for name, value := range d.Headers {
+		msg.Header.Set(name, value)
+	}
+	err := n.conn.PublishMsg(msg)
+	if err != nil {
+		return err
+	}
+	return n.conn.FlushTimeout(10 * time.Second)
+}
+
+func (n *NatsSink) Close() {
+	n.conn.Close()
+}
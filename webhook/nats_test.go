@@ -0,0 +1,139 @@
+package webhook
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A message published to the NATS stand-in
+type natsMessage struct {
+	Subject string
+	Headers textproto.MIMEHeader
+	Data    string
+}
+
+// Stand-in NATS server speaking enough of the client protocol to take publishes
+type natsServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []natsMessage
+}
+
+func newNatsServer(t *testing.T) *natsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &natsServer{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(t, conn)
+		}
+	}()
+	return server
+}
+
+func (n *natsServer) Url() string {
+	return "nats://" + n.listener.Addr().String()
+}
+
+func (n *natsServer) Messages() []natsMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]natsMessage{}, n.messages...)
+}
+
+func (n *natsServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	_, err := conn.Write([]byte(`INFO {"server_id":"standin","version":"2.2.0","proto":1,"headers":true,"max_payload":1048576}` + "\r\n"))
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "CONNECT", "PONG":
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "PUB", "HPUB":
+			// PUB <subject> [reply] <size>, HPUB <subject> [reply] <header size> <total size>
+			total, _ := strconv.Atoi(args[len(args)-1])
+			headerSize := 0
+			if strings.ToUpper(args[0]) == "HPUB" {
+				headerSize, _ = strconv.Atoi(args[len(args)-2])
+			}
+			data := make([]byte, total+2)
+			_, err = io.ReadFull(reader, data)
+			if err != nil {
+				return
+			}
+			msg := natsMessage{Subject: args[1], Data: string(data[headerSize:total])}
+			if headerSize > 0 {
+				// Headers are a NATS/1.0 status line followed by MIME headers
+				headers := textproto.NewReader(bufio.NewReader(strings.NewReader(string(data[:headerSize]))))
+				headers.ReadLine()
+				msg.Headers, _ = headers.ReadMIMEHeader()
+			}
+			n.mu.Lock()
+			n.messages = append(n.messages, msg)
+			n.mu.Unlock()
+		default:
+			t.Errorf("unexpected NATS operation %q", line)
+			return
+		}
+	}
+}
+
+func TestNatsSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		types    []string
+		want     []string
+	}{
+		{"default subject", "", []string{"Message"}, []string{"wuzapi.7.Message"}},
+		{"custom subject", "events.{userid}.{type}", []string{"Message", "ReadReceipt"}, []string{"events.7.Message", "events.7.ReadReceipt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newNatsServer(t)
+			deliverAll(t, server.Url(), tt.template, tt.types...)
+
+			// Deliver flushes, so everything published has reached the server
+			messages := server.Messages()
+			if len(messages) != len(tt.want) {
+				t.Fatalf("%d messages published, want %d", len(messages), len(tt.want))
+			}
+			for i, msg := range messages {
+				if msg.Subject != tt.want[i] {
+					t.Errorf("subject %q, want %q", msg.Subject, tt.want[i])
+				}
+				if want := `{"type":"` + tt.types[i] + `"}`; msg.Data != want {
+					t.Errorf("data %q, want %q", msg.Data, want)
+				}
+				if msg.Headers.Get("X-Source") != "wuzapi" {
+					t.Errorf("headers %v", msg.Headers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package webhook
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// A webhook call waiting in the queue or moved to the dead letters
+type Delivery struct {
+	Id     int64
+	UserId int
+	Url    string
+	// Subject, routing key or stream for broker URLs
+	Subject string
+	// Delivery format, form fields in Payload or a JSON Body
+	Format      string
+	Payload     map[string]string
+	Body        string
+	Headers     map[string]string
+	File        string
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+	Created     int64
+	Failed      int64
+}
+
+// Durable queue of webhook calls, delivered by workers with retries.
+// Calls failing MaxAttempts times are moved to the dead letters table.
+type Outbox struct {
+	Db          *sql.DB
+	Client      *resty.Client
+	Brokers     *Brokers
+	Workers     int
+	MaxAttempts int
+
+	mu       sync.Mutex
+	inflight map[int64]bool
+	wake     chan struct{}
+}
+
+func NewOutbox(db *sql.DB, client *resty.Client, workers int, maxAttempts int) *Outbox {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &Outbox{
+		Db:          db,
+		Client:      client,
+		Brokers:     NewBrokers(),
+		Workers:     workers,
+		MaxAttempts: maxAttempts,
+		inflight:    make(map[int64]bool),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Queues a webhook call for UserId to Url, with Subject, Format, Payload or Body, File and Headers as set in d
+func (o *Outbox) Enqueue(d Delivery) error {
+	if d.Format == "" {
+		d.Format = FormatForm
+	}
+	data, err := json.Marshal(d.Payload)
+	if err != nil {
+		return err
+	}
+	extra, err := json.Marshal(d.Headers)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = o.Db.Exec("INSERT INTO webhook_queue (user_id,url,subject,format,payload,body,headers,file,attempts,next_attempt,last_error,created) VALUES (?,?,?,?,?,?,?,?,0,?,'',?)", d.UserId, d.Url, d.Subject, d.Format, string(data), d.Body, string(extra), d.File, now, now)
+	if err != nil {
+		return err
+	}
+	o.notify()
+	return nil
+}
+
+// Wakes the dispatcher without waiting for the next tick
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Starts the workers and hands them due deliveries until ctx is done
+func (o *Outbox) Run(ctx context.Context) {
+	jobs := make(chan int64)
+	for i := 0; i < o.Workers; i++ {
+		go o.worker(ctx, jobs)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer o.Brokers.Close()
+	for {
+		o.dispatch(ctx, jobs)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+func (o *Outbox) dispatch(ctx context.Context, jobs chan<- int64) {
+	rows, err := o.Db.Query("SELECT id FROM webhook_queue WHERE next_attempt<=? ORDER BY next_attempt,id LIMIT 100", time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not read webhook queue")
+		return
+	}
+	var due []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not read webhook queue")
+			break
+		}
+		due = append(due, id)
+	}
+	rows.Close()
+
+	for _, id := range due {
+		o.mu.Lock()
+		busy := o.inflight[id]
+		o.inflight[id] = true
+		o.mu.Unlock()
+		if busy {
+			continue
+		}
+		select {
+		case jobs <- id:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (o *Outbox) worker(ctx context.Context, jobs <-chan int64) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case id := <-jobs:
+			o.deliver(id)
+			o.mu.Lock()
+			delete(o.inflight, id)
+			o.mu.Unlock()
+		}
+	}
+}
+
+// Makes one delivery attempt, rescheduling or dead lettering it on failure
+func (o *Outbox) deliver(id int64) {
+	d, err := scanDelivery(o.Db.QueryRow("SELECT id,user_id,url,subject,format,payload,body,headers,file,attempts,next_attempt,last_error,created,0 FROM webhook_queue WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Error().Err(err).Int64("delivery", id).Msg("Could not read webhook delivery")
+		return
+	}
+
+	err = o.send(d)
+	if err == nil {
+		_, err = o.Db.Exec("DELETE FROM webhook_queue WHERE id=?", id)
+		if err != nil {
+			log.Error().Err(err).Int64("delivery", id).Msg("Could not remove delivered webhook")
+		}
+		return
+	}
+
+	attempts := d.Attempts + 1
+	if attempts >= o.MaxAttempts {
+		log.Error().Err(err).Int64("delivery", id).Int("userid", d.UserId).Int("attempts", attempts).Msg("Webhook delivery failed, moving to dead letters")
+		err = o.moveToDeadLetters(id, attempts, err.Error())
+		if err != nil {
+			log.Error().Err(err).Int64("delivery", id).Msg("Could not move webhook to dead letters")
+		}
+		return
+	}
+
+	delay := retryDelay(attempts)
+	log.Warn().Err(err).Int64("delivery", id).Int("userid", d.UserId).Int("attempts", attempts).Str("retry_in", delay.String()).Msg("Webhook delivery failed")
+	_, err = o.Db.Exec("UPDATE webhook_queue SET attempts=?, next_attempt=?, last_error=? WHERE id=?", attempts, time.Now().Add(delay).Unix(), err.Error(), id)
+	if err != nil {
+		log.Error().Err(err).Int64("delivery", id).Msg("Could not reschedule webhook delivery")
+	}
+}
+
+// Sends a delivery to its broker, or to its HTTP receiver signed with the user secrets
+func (o *Outbox) send(d *Delivery) error {
+	if IsBroker(d.Url) {
+		sink, err := o.Brokers.Sink(d.Url)
+		if err != nil {
+			return err
+		}
+		err = sink.Deliver(d)
+		if err != nil {
+			o.Brokers.Drop(d.Url)
+		}
+		return err
+	}
+
+	secrets, err := ActiveSecrets(o.Db, d.UserId)
+	if err != nil {
+		return err
+	}
+	w := Webhook{Client: o.Client, Secrets: secrets, Headers: d.Headers}
+	return w.Deliver(d)
+}
+
+func (o *Outbox) moveToDeadLetters(id int64, attempts int, lastError string) error {
+	tx, err := o.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO webhook_dead_letters (user_id,url,subject,format,payload,body,headers,file,attempts,last_error,created,failed) SELECT user_id,url,subject,format,payload,body,headers,file,?,?,created,? FROM webhook_queue WHERE id=?", attempts, lastError, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM webhook_queue WHERE id=?", id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delay before retrying a delivery, doubling from 5 seconds up to an hour
+func retryDelay(attempts int) time.Duration {
+	delay := 5 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// Lists dead lettered deliveries, newest first, optionally for one user and before an id
+func (o *Outbox) DeadLetters(userid int, before int64, limit int) ([]Delivery, error) {
+	where := []string{"1=1"}
+	args := []interface{}{}
+	if userid > 0 {
+		where = append(where, "user_id=?")
+		args = append(args, userid)
+	}
+	if before > 0 {
+		where = append(where, "id<?")
+		args = append(args, before)
+	}
+	args = append(args, limit)
+
+	rows, err := o.Db.Query("SELECT id,user_id,url,subject,format,payload,body,headers,file,attempts,0,last_error,created,failed FROM webhook_dead_letters WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *d)
+	}
+	return list, rows.Err()
+}
+
+// Gets a dead lettered delivery, returns nil if there is none
+func (o *Outbox) DeadLetter(id int64) (*Delivery, error) {
+	d, err := scanDelivery(o.Db.QueryRow("SELECT id,user_id,url,subject,format,payload,body,headers,file,attempts,0,last_error,created,failed FROM webhook_dead_letters WHERE id=?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// Moves dead lettered deliveries back to the queue with their attempts reset.
+// Replays a single delivery if id is set, otherwise every one of userid, or all if userid is 0.
+func (o *Outbox) Replay(id int64, userid int) (int64, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if id > 0 {
+		where = "id=?"
+		args = append(args, id)
+	} else if userid > 0 {
+		where = "user_id=?"
+		args = append(args, userid)
+	}
+
+	tx, err := o.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO webhook_queue (user_id,url,subject,format,payload,body,headers,file,attempts,next_attempt,last_error,created) SELECT user_id,url,subject,format,payload,body,headers,file,0,?,last_error,created FROM webhook_dead_letters WHERE "+where+" ORDER BY id", append([]interface{}{time.Now().Unix()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM webhook_dead_letters WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	o.notify()
+	return res.RowsAffected()
+}
+
+// Deletes a dead lettered delivery for good
+func (o *Outbox) DeleteDeadLetter(id int64) (bool, error) {
+	res, err := o.Db.Exec("DELETE FROM webhook_dead_letters WHERE id=?", id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDelivery(row scanner) (*Delivery, error) {
+	d := Delivery{}
+	payload := ""
+	headers := ""
+	err := row.Scan(&d.Id, &d.UserId, &d.Url, &d.Subject, &d.Format, &payload, &d.Body, &headers, &d.File, &d.Attempts, &d.NextAttempt, &d.LastError, &d.Created, &d.Failed)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(payload), &d.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if headers != "" {
+		err = json.Unmarshal([]byte(headers), &d.Headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &d, nil
+}
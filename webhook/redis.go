@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Appends deliveries to a Redis stream named after the subject. The maxlen query
+// parameter of the URL trims streams to about that many entries.
+type RedisSink struct {
+	client *redis.Client
+	maxLen int64
+}
+
+func dialRedis(u *url.URL) (*RedisSink, error) {
+	query := u.Query()
+	maxLen := int64(0)
+	if query.Get("maxlen") != "" {
+		var err error
+		maxLen, err = strconv.ParseInt(query.Get("maxlen"), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query.Del("maxlen")
+	dial := *u
+	dial.RawQuery = query.Encode()
+
+	options, err := redis.ParseURL(dial.String())
+	if err != nil {
+		return nil, err
+	}
+	return &RedisSink{client: redis.NewClient(options), maxLen: maxLen}, nil
+}
+
+// Adds the delivery body to the stream in the payload field, headers go in fields of their own
+func (r *RedisSink) Deliver(d *Delivery) error {
+	values := []interface{}{"payload", d.Body}
+	for name, value := range d.Headers {
+		values = append(values, name, value)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: d.Subject,
+		MaxLen: r.maxLen,
+		Approx: r.maxLen > 0,
+		Values: values,
+	}).Err()
+}
+
+func (r *RedisSink) Close() {
+	r.client.Close()
+}
@@ -0,0 +1,50 @@
+package webhook
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisSink(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		template string
+		stream   string
+		deliver  int
+		want     int
+	}{
+		{"default subject", "", "", "wuzapi.7.Message", 1, 1},
+		{"custom subject", "", "events.{type}", "events.Message", 2, 2},
+		{"trimmed", "?maxlen=3", "", "wuzapi.7.Message", 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := miniredis.RunT(t)
+			types := make([]string, tt.deliver)
+			for i := range types {
+				types[i] = "Message"
+			}
+			deliverAll(t, "redis://"+server.Addr()+"/0"+tt.query, tt.template, types...)
+
+			entries, err := server.Stream(tt.stream)
+			if err != nil {
+				t.Fatalf("reading stream %s: %v", tt.stream, err)
+			}
+			if len(entries) != tt.want {
+				t.Fatalf("%d entries in %s, want %d", len(entries), tt.stream, tt.want)
+			}
+			values := map[string]string{}
+			for i := 0; i+1 < len(entries[0].Values); i += 2 {
+				values[entries[0].Values[i]] = entries[0].Values[i+1]
+			}
+			if values["payload"] != `{"type":"Message"}` {
+				t.Errorf("payload %q", values["payload"])
+			}
+			if values["X-Source"] != "wuzapi" {
+				t.Errorf("header field %q", values["X-Source"])
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Gets the secrets a user webhook deliveries are signed with, newest first.
+// A rotated secret stays active until its grace period ends.
+func ActiveSecrets(db *sql.DB, userid int) ([]string, error) {
+	rows, err := db.Query("SELECT secret FROM webhook_secrets WHERE user_id=? AND (expires=0 OR expires>?) ORDER BY id DESC", userid, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var secrets []string
+	for rows.Next() {
+		secret := ""
+		err = rows.Scan(&secret)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, rows.Err()
+}
+
+// Sets a new webhook secret for a user. The current secret keeps signing deliveries
+// until grace has passed, any older one is dropped so at most two are active.
+func RotateSecret(db *sql.DB, userid int, secret string, grace time.Duration) error {
+	now := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM webhook_secrets WHERE user_id=? AND expires!=0", userid)
+	if err != nil {
+		return err
+	}
+	if grace > 0 {
+		_, err = tx.Exec("UPDATE webhook_secrets SET expires=? WHERE user_id=? AND expires=0", now.Add(grace).Unix(), userid)
+	} else {
+		_, err = tx.Exec("DELETE FROM webhook_secrets WHERE user_id=?", userid)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO webhook_secrets (user_id,secret,created,expires) VALUES (?,?,?,0)", userid, secret, now.Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Gets when the previous secret of a user stops being used, 0 if there is none
+func PreviousSecretExpires(db *sql.DB, userid int) (int64, error) {
+	var expires sql.NullInt64
+	err := db.QueryRow("SELECT MAX(expires) FROM webhook_secrets WHERE user_id=? AND expires>?", userid, time.Now().Unix()).Scan(&expires)
+	return expires.Int64, err
+}
+
+// Removes every webhook secret of a user, deliveries are sent unsigned afterwards
+func RemoveSecrets(db *sql.DB, userid int) error {
+	_, err := db.Exec("DELETE FROM webhook_secrets WHERE user_id=?", userid)
+	return err
+}
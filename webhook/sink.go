@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default subject, routing key or stream deliveries to brokers are published to
+const DefaultSubject = "wuzapi.{userid}.{type}"
+
+// Destination of webhook deliveries. Webhook posts them over HTTP, brokers
+// publish them to a subject, routing key or stream.
+type Sink interface {
+	Deliver(d *Delivery) error
+}
+
+// A sink keeping a connection open between deliveries
+type brokerSink interface {
+	Sink
+	Close()
+}
+
+// Returned for broker URLs set as the user webhook, which only takes HTTP receivers.
+// Brokers are added as webhook endpoints, which render their subject.
+var ErrBrokerWebhook = errors.New("Webhook can not be a broker url, add it as a webhook endpoint instead")
+
+// Tells if a delivery URL points to a message broker instead of an HTTP receiver
+func IsBroker(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "nats", "tls", "amqp", "amqps", "redis", "rediss":
+		return true
+	}
+	return false
+}
+
+// Fills the {userid} and {type} placeholders of a subject template
+func RenderSubject(template string, userid int, eventType string) string {
+	if template == "" {
+		template = DefaultSubject
+	}
+	return strings.NewReplacer("{userid}", strconv.Itoa(userid), "{type}", eventType).Replace(template)
+}
+
+// Broker connections shared by the outbox workers, one per broker URL.
+// A connection is dropped after a failed delivery and opened again on the next one.
+type Brokers struct {
+	mu    sync.Mutex
+	sinks map[string]brokerSink
+}
+
+func NewBrokers() *Brokers {
+	return &Brokers{sinks: make(map[string]brokerSink)}
+}
+
+// Gets the sink for a broker URL, connecting if needed
+func (b *Brokers) Sink(rawurl string) (Sink, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sink, ok := b.sinks[rawurl]; ok {
+		return sink, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	var sink brokerSink
+	switch u.Scheme {
+	case "nats", "tls":
+		sink, err = dialNats(rawurl)
+	case "amqp", "amqps":
+		sink, err = dialAmqp(u)
+	case "redis", "rediss":
+		sink, err = dialRedis(u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.sinks[rawurl] = sink
+	return sink, nil
+}
+
+// Closes the connection to a broker after a failure
+func (b *Brokers) Drop(rawurl string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if sink, ok := b.sinks[rawurl]; ok {
+		sink.Close()
+		delete(b.sinks, rawurl)
+	}
+}
+
+// Closes every broker connection
+func (b *Brokers) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for rawurl, sink := range b.sinks {
+		sink.Close()
+		delete(b.sinks, rawurl)
+	}
+}
@@ -1,28 +1,158 @@
 package webhook
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog/log"
 )
 
+// Headers sent with signed deliveries
+const (
+	TimestampHeader = "X-Wuzapi-Timestamp"
+	SignatureHeader = "X-Wuzapi-Signature"
+)
+
+// Delivery formats
+const (
+	// Form fields, events in a jsonData field as sent by earlier versions
+	FormatForm = "form"
+	// The event envelope as an application/json body
+	FormatJSON = "json"
+)
+
+// How downloaded media is sent along with an event
+const (
+	// The file is uploaded in a multipart body
+	MediaMultipart = "multipart"
+	// The file is embedded base64 encoded
+	MediaBase64 = "base64"
+	// A signed link to download the file is included
+	MediaURL = "url"
+)
+
 type Webhook struct {
-	ClientHttp map[int]*resty.Client
+	Client *resty.Client
+	// Active secrets of the user, deliveries are signed with each of them
+	Secrets []string
+	// Extra headers configured for the endpoint
+	Headers map[string]string
 }
 
 // webhook for regular messages
-func (w *Webhook) CallHook(myurl string, payload map[string]string, id int) {
+func (w *Webhook) CallHook(myurl string, payload map[string]string, id int) error {
 	log.Info().Str("url", myurl).Msg("Sending POST")
-	_, err := w.ClientHttp[id].R().SetFormData(payload).Post(myurl)
-
-	if err != nil {
-		log.Debug().Str("error", err.Error())
+	form := url.Values{}
+	for key, value := range payload {
+		form.Set(key, value)
 	}
+	return w.post(myurl, "application/x-www-form-urlencoded", []byte(form.Encode()))
 }
 
 // webhook for messages with file attachments
-func (w *Webhook) CallHookFile(myurl string, payload map[string]string, id int, file string) {
+func (w *Webhook) CallHookFile(myurl string, payload map[string]string, id int, file string) error {
 	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
-	w.ClientHttp[id].R().SetFiles(map[string]string{
-		"file": file,
-	}).SetFormData(payload).Post(myurl)
+
+	// The body is built here so the exact bytes sent can be signed
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for key, value := range payload {
+		err := writer.WriteField(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filepath.Base(file)))
+	header.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return w.post(myurl, writer.FormDataContentType(), body.Bytes())
+}
+
+// Sends a queued delivery in its format
+func (w *Webhook) Deliver(d *Delivery) error {
+	if d.Format == FormatJSON {
+		if d.File == "" {
+			log.Info().Str("url", d.Url).Msg("Sending POST")
+			return w.post(d.Url, "application/json", []byte(d.Body))
+		}
+		// The envelope goes in a payload field next to the uploaded file
+		return w.CallHookFile(d.Url, map[string]string{"payload": d.Body}, d.UserId, d.File)
+	}
+	if d.File == "" {
+		return w.CallHook(d.Url, d.Payload, d.UserId)
+	}
+	return w.CallHookFile(d.Url, d.Payload, d.UserId, d.File)
+}
+
+func (w *Webhook) post(myurl string, contentType string, body []byte) error {
+	req := w.Client.R().SetHeaders(w.Headers).SetHeader("Content-Type", contentType).SetBody(body)
+	if len(w.Secrets) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.SetHeader(TimestampHeader, timestamp)
+		req.SetHeader(SignatureHeader, Sign(w.Secrets, timestamp, body))
+	}
+	resp, err := req.Post(myurl)
+	return checkResponse(resp, err)
+}
+
+// Signs timestamp and body with every secret as comma separated v1=<hex hmac-sha256> values.
+// Receivers should accept a delivery if any of the values matches one of their secrets.
+func Sign(secrets []string, timestamp string, body []byte) string {
+	signatures := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		signatures = append(signatures, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(signatures, ",")
+}
+
+// Only 2xx responses count as delivered
+func checkResponse(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if !resp.IsSuccess() {
+		return fmt.Errorf("Unexpected response status %d", resp.StatusCode())
+	}
+	return nil
 }